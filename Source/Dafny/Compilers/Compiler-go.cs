@@ -42,6 +42,7 @@ namespace Microsoft.Dafny.Compilers {
       $"{Path.GetFileNameWithoutExtension(dafnyProgramName)}-go/src";
 
     public override bool SupportsInMemoryCompilation => false;
+    public override bool SupportsMainArguments => true;
     public override bool TextualTargetIsExecutable => false;
 
     static string FormatDefaultTypeParameterValue(TopLevelDecl tp) {
@@ -78,6 +79,54 @@ namespace Microsoft.Dafny.Compilers {
 
       var rt = wr.NewFile("dafny/dafny.go");
       ReadRuntimeSystem(program, "DafnyRuntime.go", rt);
+
+      // Externs that publish the runtime statistics import DafnyStats, which only they link in
+      var stats = wr.NewFile("DafnyStats/DafnyStats.go");
+      ReadRuntimeSystem(program, "DafnyStats.go", stats);
+
+      // The extern part of the I/O library in DafnyIO.dfy ships with the runtime
+      if (program.CompileModules.Exists(m => m.Name == DafnyIOExternsModuleName && Attributes.Contains(m.Attributes, "extern"))) {
+        var io = wr.NewFile($"{DafnyIOExternsModuleName}/{DafnyIOExternsModuleName}.go");
+        ReadRuntimeSystem(program, "DafnyIO.go", io);
+      }
+
+      // The coverage calls emitted by CoverageInstrumenter go to the DafnyProfiling package imported in OnPreCompile
+      if (DafnyOptions.O.CoverageLegendFile != null) {
+        var profiling = wr.NewFile("DafnyProfiling/DafnyProfiling.go");
+        ReadRuntimeSystem(program, "DafnyProfiling.go", profiling);
+        if (DafnyOptions.O.CoverageLegendFile != "-") {
+          var legendFile = Path.GetFullPath(DafnyOptions.O.CoverageLegendFile);
+          wr.NewBlock("func init()").WriteLine("DafnyProfiling.CodeCoverage.SetLegendFile(\"{0}\")", legendFile.Replace("\\", "\\\\").Replace("\"", "\\\""));
+          wr.WriteLine();
+        }
+      }
+
+      EmitTestEntryPoint(program, wr);
+    }
+
+    const string DafnyIOExternsModuleName = "DafnyIOExterns";
+
+    // Lets "go test" run the program's {:test} methods, which register themselves with the runtime.
+    // The DafnyTesting package that runs them imports "testing", so it's kept out of the runtime proper.
+    private void EmitTestEntryPoint(Program program, ConcreteSyntaxTree wr) {
+      var hasTests = program.CompileModules.Exists(module =>
+        ModuleDefinition.AllCallables(module.TopLevelDecls).Any(callable => callable is Method m && IsTestMethod(m)));
+      if (!hasTests) {
+        return;
+      }
+      var testing = wr.NewFile("DafnyTesting/DafnyTesting.go");
+      ReadRuntimeSystem(program, "DafnyTesting.go", testing);
+      var w = wr.NewFile($"{Path.GetFileNameWithoutExtension(program.Name)}_test.go");
+      w.WriteLine("// Runs the {{:test}} methods of Dafny program {0}", program.Name);
+      w.WriteLine();
+      w.WriteLine("package {0}", ModuleName);
+      w.WriteLine();
+      w.WriteLine("import (");
+      w.WriteLine("  DafnyTesting \"DafnyTesting\"");
+      w.WriteLine("  \"testing\"");
+      w.WriteLine(")");
+      w.WriteLine();
+      w.NewBlock("func TestDafny(t *testing.T)").WriteLine("DafnyTesting.RunTests(t)");
     }
 
     protected override void EmitBuiltInDecls(BuiltIns builtIns, ConcreteSyntaxTree wr) {
@@ -113,13 +162,18 @@ namespace Microsoft.Dafny.Compilers {
       var companion = TypeName_Companion(UserDefinedType.FromTopLevelDeclWithAllBooleanTypeParameters(mainMethod.EnclosingClass), wr, mainMethod.tok, mainMethod);
 
       var wBody = wr.NewNamedBlock("func main()");
-      wBody.WriteLine("defer _dafny.CatchHalt()");
+      wBody.WriteLine("defer _dafny.EndMain()");
 
       var idName = IssueCreateStaticMain(mainMethod) ? "Main" : IdName(mainMethod);
+      var takesArguments = mainMethod.Ins.Exists(f => !f.IsGhost);
 
       Coverage.EmitSetup(wBody);
-      wBody.WriteLine("{0}.{1}()", companion, idName);
-      Coverage.EmitTearDown(wBody);
+      if (Coverage.IsRecording) {
+        // Deferred, so that the coverage is reported even if the program halts
+        wBody.Write("defer ");
+        Coverage.EmitTearDown(wBody);
+      }
+      wBody.WriteLine("{0}.{1}({2})", companion, idName, takesArguments ? "_dafny.MainArguments()" : "");
     }
 
     ConcreteSyntaxTree CreateDescribedSection(string desc, ConcreteSyntaxTree wr, params object[] args) {
@@ -382,55 +436,45 @@ namespace Microsoft.Dafny.Compilers {
     protected override bool SupportsProperties => false;
 
     protected override ConcreteSyntaxTree CreateIterator(IteratorDecl iter, ConcreteSyntaxTree wr) {
-      // FIXME: There should be tests to make sure that the finalizer mechanism achieves what I hope it does, namely allowing the iterator's goroutine to be garbage-collected along with the iterator.
+      // The body of the iterator runs as a _dafny.Coroutine, which starts its
+      // goroutine on the first call to MoveNext.  The goroutine ends when the
+      // body does or when the iterator is closed.  There's no finalizer: while
+      // the body is suspended in a yield, its goroutine refers to the iterator,
+      // so the iterator would never be collected.  An iterator that is started
+      // but not run to completion must be closed explicitly, or its goroutine
+      // leaks; _dafny.LiveCoroutines and _dafny.TrackCoroutines help to find
+      // such leaks.
       //
       // type MyIteratorExample struct {
-      //   cont chan<- struct{}
-      //   yielded <-chan struct{}
+      //   co *_dafny.Coroutine
       //
       //   // Fields
       // }
       //
       // func (_this * MyIteratorExample) Ctor__(/* params */) {
-      //   _cont := make(chan struct{})
-      //   _yielded := make(chan struct{})
-      //   _this.cont = _cont
-      //   _this.yielded = _yielded
       //   // assign params
       //
-      //   go _this.run(_cont, _yielded)
-      //
-      //   _dafny.SetFinalizer(this_, func(_ MyIteratorExample) {
-      //     close(_cont) // will cause the iterator to return and close _yielded
-      //   })
+      //   _this.co = _dafny.NewCoroutine(_this.run)
       // }
       //
       // func (_this * MyIteratorExample) MoveNext() bool {
-      //   _this.cont <- struct{}{}
-      //   _, ok <- _this.yielded
-      //
-      //   return ok
+      //   return _this.co.Resume()
       // }
       //
-      // func (_this * MyIteratorExample) run(_cont <-chan struct{}, _yielded chan<- struct{}) {
-      //   defer close(_yielded)
-      //
-      //   var _ok bool
-      //   _, _ok = <- _cont
-      //   if !_ok { return }
+      // func (_this * MyIteratorExample) Close() {
+      //   _this.co.Close()
+      // }
       //
+      // func (_this * MyIteratorExample) run(_yield func() bool) {
       //   // Statements ... yield becomes:
-      //   _yielded <- struct{}{}
-      //   _, _ok = <- _cont
-      //   if !_ok { return }
+      //   if !_yield() { return }
       //
       //   // break becomes:
       //   return
-      // }()
+      // }
       var cw = CreateClass(IdName(iter), false, null, iter.TypeArgs, null, null, wr, includeRtd: false, includeEquals: false);
 
-      cw.InstanceFieldWriter.WriteLine("cont chan<- struct{}");
-      cw.InstanceFieldWriter.WriteLine("yielded <-chan struct{}");
+      cw.InstanceFieldWriter.WriteLine("co *_dafny.Coroutine");
 
       Constructor ct = null;
       foreach (var member in iter.Members) {
@@ -453,33 +497,21 @@ namespace Microsoft.Dafny.Compilers {
         }
       }
       var wCtor = cw.ConcreteMethodWriter.NewBlock(")");
-      wCtor.WriteLine("_cont := make(chan struct{})");
-      wCtor.WriteLine("_yielded := make(chan struct{})");
-      wCtor.WriteLine("_this.cont = _cont");
-      wCtor.WriteLine("_this.yielded = _yielded");
-      wCtor.WriteLine();
       foreach (var p in ct.Ins) {
         if (!p.IsGhost) {
           wCtor.WriteLine("_this.{0} = {1}", Capitalize(IdName(p)), IdName(p));
         }
       }
       wCtor.WriteLine();
-      wCtor.WriteLine("go _this.run(_cont, _yielded)");
-      wCtor.WriteLine();
-      wCtor.WriteLine("_dafny.SetFinalizer(_this, func(_ * {0}) {{ close(_cont) }})", IdName(iter));
+      wCtor.WriteLine("_this.co = _dafny.NewCoroutine(_this.run)");
 
       var wMoveNext = cw.ConcreteMethodWriter.NewNamedBlock("func (_this * {0}) MoveNext() bool", IdName(iter));
-      wMoveNext.WriteLine("_this.cont <- struct{}{}");
-      wMoveNext.WriteLine("_, ok := <- _this.yielded");
-      wMoveNext.WriteLine();
-      wMoveNext.WriteLine("return ok");
-
-      var wRun = cw.ConcreteMethodWriter.NewNamedBlock("func (_this * {0}) run(_cont <-chan struct{{}}, _yielded chan<- struct{{}})", IdName(iter));
-      wRun.WriteLine("defer close(_yielded)");
-      wRun.WriteLine();
-      wRun.WriteLine("_, _ok := <- _cont");
-      wRun.WriteLine("if !_ok { return }");
-      wRun.WriteLine();
+      wMoveNext.WriteLine("return _this.co.Resume()");
+
+      var wClose = cw.ConcreteMethodWriter.NewNamedBlock("func (_this * {0}) Close()", IdName(iter));
+      wClose.WriteLine("_this.co.Close()");
+
+      var wRun = cw.ConcreteMethodWriter.NewNamedBlock("func (_this * {0}) run(_yield func() bool)", IdName(iter));
 
       return wRun;
     }
@@ -801,7 +833,7 @@ namespace Microsoft.Dafny.Compilers {
             foreach (var arg in ctor.Formals) {
               if (!arg.IsGhost) {
                 anyFormals = true;
-                wCase.Write("{0}_dafny.String(data.{1})", sep, DatatypeFieldName(arg, k));
+                wCase.Write("{0}_dafny.StringOfElement(data.{1})", sep, DatatypeFieldName(arg, k));
                 sep = " + \", \" + ";
                 k++;
               }
@@ -1067,9 +1099,47 @@ namespace Microsoft.Dafny.Compilers {
     protected ConcreteSyntaxTree/*?*/ CreateMethod(Method m, List<TypeArgumentInstantiation> typeArgs, bool createBody, string ownerName, ConcreteSyntaxTree abstractWriter, ConcreteSyntaxTree concreteWriter, bool forBodyInheritance, bool lookasideBody) {
       var overriddenIns = m.EnclosingClass is TraitDecl && !forBodyInheritance ? null : m.OverriddenMethod?.Original.Ins;
       var overriddenOuts = m.EnclosingClass is TraitDecl && !forBodyInheritance ? null : m.OverriddenMethod?.Original.Outs;
-      return CreateSubroutine(IdName(m), typeArgs, m.Ins, m.Outs, null,
+      var body = CreateSubroutine(IdName(m), typeArgs, m.Ins, m.Outs, null,
         overriddenIns, overriddenOuts, null,
         m.tok, m.IsStatic, createBody, ownerName, m, abstractWriter, concreteWriter, forBodyInheritance, lookasideBody);
+      if (createBody && !forBodyInheritance && IsTestMethod(m)) {
+        EmitTestRegistration(m, ownerName, concreteWriter);
+      }
+      return body;
+    }
+
+    private static bool IsTestMethod(Method m) {
+      return Attributes.Contains(m.Attributes, "test") && m.IsStatic && m.TypeArgs.Count == 0 && m.Ins.TrueForAll(f => f.IsGhost);
+    }
+
+    // Registers a {:test} method with the runtime, so that it runs under "go test":
+    //
+    // func init() {
+    //   _dafny.RegisterTest("Module.TestMethod", func() interface{} {
+    //     var result = Companion_Default___.TestMethod()
+    //     if result.IsFailure() {
+    //       return result
+    //     }
+    //     return nil
+    //   })
+    // }
+    //
+    // where the result is checked only if the method has a single, failure-compatible out-parameter.
+    private void EmitTestRegistration(Method m, string ownerName, ConcreteSyntaxTree wr) {
+      var outs = m.Outs.FindAll(f => !f.IsGhost);
+      // As with the xUnit tests of the C# compiler, only a failure-compatible result can fail the test
+      var returnsFailureCompatible = outs.Count == 1 &&
+        (outs[0].Type?.AsTopLevelTypeWithMembers?.Members?.Any(member => member.Name == "IsFailure") ?? false);
+      var wInit = wr.NewBlock("func init()");
+      var wTest = wInit.NewBlock($"_dafny.RegisterTest(\"{m.FullDafnyName}\", func() interface{{}}", ")");
+      var call = $"{FormatCompanionName(ownerName)}.{IdName(m)}()";
+      if (returnsFailureCompatible) {
+        wTest.WriteLine($"var result = {call}");
+        wTest.NewBlock("if result.IsFailure()").WriteLine("return result");
+      } else {
+        wTest.WriteLine(call);
+      }
+      wTest.WriteLine("return nil");
     }
 
     protected ConcreteSyntaxTree/*?*/ CreateFunction(string name, List<TypeArgumentInstantiation> typeArgs, List<Formal> formals, Type resultType, IToken tok, bool isStatic, bool createBody,
@@ -1127,6 +1197,16 @@ namespace Microsoft.Dafny.Compilers {
 
       if (createBody) {
         var w = wr.NewBlock("");
+        if (!forBodyInheritance) {
+          if (DafnyOptions.O.CheckCancellation) {
+            // Let a runaway computation, such as a deep recursion, be canceled
+            w.WriteLine("_dafny.CheckCanceled()");
+          }
+          if (DafnyOptions.O.ProfileCalls && (member is Method || member is Function)) {
+            // Report the call under its Dafny name when call profiling is on
+            w.NewBlock("if _dafny.ProfilingEnabled()").WriteLine("defer _dafny.ProfileCall(\"{0}\")()", member.FullDafnyName);
+          }
+        }
         // Go doesn't have type parameters. Instead, the empty interface type is used as the type of what would have been type parameters.
         // If this is a routine inherited from a trait, then the Dafny signature of the method may have replaced the trait's type parameters.
         // Go has no direct support for this idiom. Instead, we re-declare the in-parameters with the actual type, let the re-declarations
@@ -1269,14 +1349,20 @@ namespace Microsoft.Dafny.Compilers {
         } else {
           return "_dafny.IntType";
         }
-      } else if (xType is SetType) {
-        return "_dafny.SetType";
-      } else if (xType is MultiSetType) {
-        return "_dafny.MultiSetType";
-      } else if (xType is SeqType) {
-        return "_dafny.SeqType";
-      } else if (xType is MapType) {
-        return "_dafny.MapType";
+      } else if (xType is SetType setType) {
+        // Collection RTDs carry their element types, which the runtime's Generator needs, when those have RTDs
+        var elt = ElementTypeDescriptor(setType.Arg, wr, tok);
+        return elt == null ? "_dafny.SetType" : $"_dafny.SetTypeOf({elt})";
+      } else if (xType is MultiSetType multiSetType) {
+        var elt = ElementTypeDescriptor(multiSetType.Arg, wr, tok);
+        return elt == null ? "_dafny.MultiSetType" : $"_dafny.MultiSetTypeOf({elt})";
+      } else if (xType is SeqType seqType) {
+        var elt = ElementTypeDescriptor(seqType.Arg, wr, tok);
+        return elt == null ? "_dafny.SeqType" : $"_dafny.SeqTypeOf({elt})";
+      } else if (xType is MapType mapType) {
+        var key = ElementTypeDescriptor(mapType.Domain, wr, tok);
+        var value = ElementTypeDescriptor(mapType.Range, wr, tok);
+        return key == null || value == null ? "_dafny.MapType" : $"_dafny.MapTypeOf({key}, {value})";
       } else if (xType.IsRefType) {
         return string.Format("_dafny.CreateStandardTypeDescriptor({0})", TypeInitializationValue(xType, wr, tok, false, true));
       } else if (xType.IsArrayType) {
@@ -1312,6 +1398,25 @@ namespace Microsoft.Dafny.Compilers {
       }
     }
 
+    /// <summary>
+    /// Returns the RTD of the element type of a collection, or null if the element type, or one of its
+    /// type arguments, has no RTD that can be referred to, as is the case for a type parameter without
+    /// a compiled value or an opaque type.
+    /// </summary>
+    private string ElementTypeDescriptor(Type type, ConcreteSyntaxTree wr, IToken tok) {
+      return HasTypeDescriptor(type) ? TypeDescriptor(type, wr, tok) : null;
+    }
+
+    private bool HasTypeDescriptor(Type type) {
+      var xType = type.NormalizeExpandKeepConstraints();
+      if (xType.IsTypeParameter) {
+        return NeedsTypeDescriptor(xType.AsTypeParameter);
+      } else if (xType.IsOpaqueType || xType.IsInternalTypeSynonym) {
+        return false;
+      }
+      return xType.TypeArgs.All(HasTypeDescriptor);
+    }
+
     protected ConcreteSyntaxTree/*?*/ CreateGetter(string name, Type resultType, IToken tok, bool isStatic, bool createBody, MemberDecl/*?*/ member, string ownerName, ConcreteSyntaxTree abstractWriter, ConcreteSyntaxTree concreteWriter, bool forBodyInheritance) {
       return CreateFunction(name, new List<TypeArgumentInstantiation>(), new List<Formal>(), resultType, tok, isStatic, createBody, member, ownerName, abstractWriter, concreteWriter, forBodyInheritance, false);
     }
@@ -1343,6 +1448,10 @@ namespace Microsoft.Dafny.Compilers {
     protected override ConcreteSyntaxTree EmitTailCallStructure(MemberDecl member, ConcreteSyntaxTree wr) {
       wr.WriteLine("goto TAIL_CALL_START");
       wr.WriteLine("TAIL_CALL_START:");
+      if (DafnyOptions.O.CheckCancellation) {
+        // Tail calls jump here rather than entering the routine again
+        wr.WriteLine("_dafny.CheckCanceled()");
+      }
       return wr;
     }
 
@@ -1828,9 +1937,7 @@ namespace Microsoft.Dafny.Compilers {
     }
 
     protected override void EmitYield(ConcreteSyntaxTree wr) {
-      wr.WriteLine("_yielded <- struct{}{}");
-      wr.WriteLine("_, _ok = <- _cont");
-      wr.WriteLine("if !_ok { return }");
+      wr.WriteLine("if !_yield() { return }");
     }
 
     protected override void EmitAbsurd(string/*?*/ message, ConcreteSyntaxTree wr) {
@@ -1856,6 +1963,9 @@ namespace Microsoft.Dafny.Compilers {
       wr.Write("for ");
       guardWriter = wr.Fork();
       var wBody = wr.NewBlock("");
+      if (DafnyOptions.O.CheckCancellation) {
+        wBody.WriteLine("_dafny.CheckCanceled()");
+      }
       return wBody;
     }
 
@@ -1918,7 +2028,22 @@ namespace Microsoft.Dafny.Compilers {
     }
 
     protected override string GetQuantifierName(string bvType) {
-      return "_dafny.Quantifier";
+      return "_dafny.QuantifierOf";
+    }
+
+    protected override string DeclareAssignSuchThatSite(IToken tok, ConcreteSyntaxTree wr) {
+      var site = idGenerator.FreshId("_choiceSite");
+      var name = Dafny.ErrorReporter.TokenToString(tok).Replace("\\", "\\\\").Replace("\"", "\\\"");
+      DeclareLocalVar(site, null, null, wr).Write("_dafny.EnterChoice(\"{0}\")", name);
+      return site;
+    }
+
+    protected override ConcreteSyntaxTree WrapAssignSuchThatPool(ConcreteSyntaxTree collection, string site, int variable) {
+      var wr = new ConcreteSyntaxTree();
+      wr.Write("{0}.Choices({1}, ", site, variable);
+      wr.Append(collection);
+      wr.Write(")");
+      return wr;
     }
 
     protected override ConcreteSyntaxTree CreateForeachLoop(string tmpVarName, Type collectionElementType, IToken tok,
@@ -1934,6 +2059,17 @@ namespace Microsoft.Dafny.Compilers {
       return wBody;
     }
 
+    protected override ConcreteSyntaxTree CreateComprehensionForeachLoop(CollectionType ct, string collectionName,
+      string tmpVarName, Type collectionElementType,
+      IToken tok, out ConcreteSyntaxTree collectionWriter, ConcreteSyntaxTree wr) {
+      // The runtime splits the values among workers when parallel evaluation is on, each chunk adding to a
+      // builder of its own, which is passed to the body under the name of the comprehension's builder
+      var (build, builderType) = ct is MapType ? ("ParallelMapBuild", "MapBuilder") : ("ParallelBuild", "Builder");
+      wr.Write("{0} = _dafny.{1}(", collectionName, build);
+      collectionWriter = wr.Fork();
+      return wr.NewBlock($", func({tmpVarName} interface{{}}, {collectionName} *_dafny.{builderType})", ")");
+    }
+
     [CanBeNull]
     protected override string GetSubtypeCondition(string tmpVarName, Type boundVarType, IToken tok, ConcreteSyntaxTree wPreconditions) {
       var conditions = new List<string> { };
@@ -2032,6 +2168,9 @@ namespace Microsoft.Dafny.Compilers {
       }
 
       wr.Write(")");
+      if (!mustInitialize && elmtType.IsCharType) {
+        wr.Write(".SetString()");
+      }
     }
 
     protected override void EmitLiteralExpr(ConcreteSyntaxTree wr, LiteralExpr e) {
@@ -3464,7 +3603,7 @@ namespace Microsoft.Dafny.Compilers {
 
     protected override void EmitMapBuilder_New(ConcreteSyntaxTree wr, MapComprehension e, string collectionName) {
       var wrVarInit = DeclareLocalVar(collectionName, null, null, wr);
-      wrVarInit.Write("_dafny.NewMapBuilder()");
+      wrVarInit.Write("_dafny.NewStrictMapBuilder()");
     }
 
     protected override void EmitSetBuilder_Add(CollectionType ct, string collName, Expression elmt, bool inLetExprBody, ConcreteSyntaxTree wr) {
@@ -3500,7 +3639,7 @@ namespace Microsoft.Dafny.Compilers {
         wr.Write("{0}.IntegerRange(", TypeName_Companion(type.AsNewtype, wr, tok: Token.NoToken));
         result = type;
       } else {
-        wr.Write("_dafny.IntegerRange(");
+        wr.Write("_dafny.IntegerRangeOf(");
         result = new IntType();
       }
       wLo = wr.Fork();
@@ -3518,7 +3657,7 @@ namespace Microsoft.Dafny.Compilers {
       var funcBlock = wr.NewBlock("func()", close: BlockStyle.Brace);
       var deferBlock = funcBlock.NewBlock("defer func()", close: BlockStyle.Brace);
       var ifRecoverBlock = deferBlock.NewBlock("if r := recover(); r != nil");
-      ifRecoverBlock.WriteLine($"var {haltMessageVarName} = _dafny.SeqOfString(r.(string))");
+      ifRecoverBlock.WriteLine($"var {haltMessageVarName} = _dafny.HaltMessage(r)");
       TrStmt(recoveryBody, ifRecoverBlock);
       funcBlock.WriteLine("()");
       TrStmt(body, funcBlock);
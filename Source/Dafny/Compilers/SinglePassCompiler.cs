@@ -559,6 +559,24 @@ namespace Microsoft.Dafny.Compilers {
 
     protected abstract string GetQuantifierName(string bvType);
 
+    /// <summary>
+    /// Called at the start of the assign-such-that statement at "tok", before its candidate values are searched.
+    /// A target may declare a local variable that identifies this execution of the statement, and return its
+    /// name, which is then passed to WrapAssignSuchThatPool.  By default, nothing is declared and null is returned.
+    /// </summary>
+    protected virtual string DeclareAssignSuchThatSite(IToken tok, ConcreteSyntaxTree wr) {
+      return null;
+    }
+
+    /// <summary>
+    /// Wraps the collection of candidate values for the variable with index "variable" of an assign-such-that
+    /// statement, which is searched for the first value satisfying the constraint.  "site" is the name returned by
+    /// DeclareAssignSuchThatSite.  By default, the collection is searched in its own order.
+    /// </summary>
+    protected virtual ConcreteSyntaxTree WrapAssignSuchThatPool(ConcreteSyntaxTree collection, string/*?*/ site, int variable) {
+      return collection;
+    }
+
     /// <summary>
     /// Emit a loop like this:
     ///     foreach (tmpVarName:collectionElementType in [[collectionWriter]]) {
@@ -572,6 +590,17 @@ namespace Microsoft.Dafny.Compilers {
       string tmpVarName, Type collectionElementType,
       IToken tok, out ConcreteSyntaxTree collectionWriter, ConcreteSyntaxTree wr);
 
+    /// <summary>
+    /// Like CreateForeachLoop, but for the outermost loop of a set or map comprehension, whose body does nothing
+    /// but add elements to the builder "collectionName" of a collection of type "ct".  A target may evaluate the
+    /// iterations of such a loop in any order, or in parallel, as long as the collection built is the same.
+    /// </summary>
+    protected virtual ConcreteSyntaxTree CreateComprehensionForeachLoop(CollectionType ct, string collectionName,
+      string tmpVarName, Type collectionElementType,
+      IToken tok, out ConcreteSyntaxTree collectionWriter, ConcreteSyntaxTree wr) {
+      return CreateForeachLoop(tmpVarName, collectionElementType, tok, out collectionWriter, wr);
+    }
+
     /// <summary>
     /// Creates a guarded foreach loop that iterates over a collection, and apply required subtype
     /// and compiled subset types filters. Will not emit intermediate ifs if there is no need.
@@ -590,9 +619,15 @@ namespace Microsoft.Dafny.Compilers {
       string tmpVarName, Type collectionElementType,
       IVariable boundVar,
       bool introduceBoundVar, bool inLetExprBody,
-      IToken tok, ConcreteSyntaxTree collection, ConcreteSyntaxTree wr
+      IToken tok, ConcreteSyntaxTree collection, ConcreteSyntaxTree wr,
+      CollectionType/*?*/ builderType = null, string/*?*/ builderName = null
       ) {
-      wr = CreateForeachLoop(tmpVarName, collectionElementType, tok, out var collectionWriter, wr);
+      ConcreteSyntaxTree collectionWriter;
+      if (builderName != null) {
+        wr = CreateComprehensionForeachLoop(builderType, builderName, tmpVarName, collectionElementType, tok, out collectionWriter, wr);
+      } else {
+        wr = CreateForeachLoop(tmpVarName, collectionElementType, tok, out collectionWriter, wr);
+      }
       collectionWriter.Append(collection);
       wr = MaybeInjectSubtypeConstraint(tmpVarName, collectionElementType, boundVar.Type, inLetExprBody, tok, wr);
       EmitDowncastVariableAssignment(IdName(boundVar), boundVar.Type, tmpVarName, collectionElementType,
@@ -1630,7 +1665,8 @@ namespace Microsoft.Dafny.Compilers {
       Contract.Requires(m.EnclosingClass is TopLevelDeclWithMembers);
       // In order to be a legal Main() method, the following must be true:
       //    The method is not a ghost method
-      //    The method takes no non-ghost parameters and no type parameters
+      //    The method takes no non-ghost parameters and no type parameters, except that a static method
+      //      may take the command-line arguments as a seq<string> if the compiler supports that
       //    The enclosing type does not take any type parameters
       //    If the method is an instance (that is, non-static) method in a class, then the enclosing class must not declare any constructor
       // In addition, either:
@@ -1671,7 +1707,9 @@ namespace Microsoft.Dafny.Compilers {
           }
         }
       }
-      if (!m.Ins.TrueForAll(f => f.IsGhost)) {
+      var nonGhostIns = m.Ins.FindAll(f => !f.IsGhost);
+      if (nonGhostIns.Count != 0 && !(nonGhostIns.Count == 1 && m.IsStatic && IsMainArgumentsType(nonGhostIns[0].Type) &&
+                                       DafnyOptions.O.Compiler.SupportsMainArguments)) {
         reason = "the method has non-ghost parameters";
         return false;
       }
@@ -1695,6 +1733,13 @@ namespace Microsoft.Dafny.Compilers {
       return true;
     }
 
+    /// <summary>
+    /// Returns whether the given type is seq<string>, the type of command-line arguments to a main method.
+    /// </summary>
+    public static bool IsMainArgumentsType(Type type) {
+      return type.AsSeqType is SeqType seq && seq.Arg.AsSeqType is SeqType str && str.Arg.IsCharType;
+    }
+
     void OrderedBySCC(List<MemberDecl> decls, TopLevelDeclWithMembers c) {
       List<ConstantField> consts = new List<ConstantField>();
       foreach (var decl in decls) {
@@ -2943,7 +2988,7 @@ namespace Microsoft.Dafny.Compilers {
             }
           } else {
             Contract.Assert(s.Bounds != null);
-            TrAssignSuchThat(lhss, s.Expr, s.Bounds, s.Tok.line, wr, false);
+            TrAssignSuchThat(lhss, s.Expr, s.Bounds, s.Tok, wr, false);
           }
         }
 
@@ -3507,7 +3552,7 @@ namespace Microsoft.Dafny.Compilers {
         TrLocalVar(bv, false, wr);
       }
       var ivars = exists.BoundVars.ConvertAll(bv => (IVariable)bv);
-      TrAssignSuchThat(ivars, exists.Term, exists.Bounds, exists.tok.line, wr, false);
+      TrAssignSuchThat(ivars, exists.Term, exists.Bounds, exists.tok, wr, false);
     }
 
     private bool CanSequentializeForall(List<BoundVar> bvs, List<ComprehensionExpr.BoundedPool> bounds, Expression range, Expression lhs, Expression rhs) {
@@ -3634,7 +3679,7 @@ namespace Microsoft.Dafny.Compilers {
       }
     }
 
-    private void TrAssignSuchThat(List<IVariable> lhss, Expression constraint, List<ComprehensionExpr.BoundedPool> bounds, int debuginfoLine, ConcreteSyntaxTree wr, bool inLetExprBody) {
+    private void TrAssignSuchThat(List<IVariable> lhss, Expression constraint, List<ComprehensionExpr.BoundedPool> bounds, IToken tok, ConcreteSyntaxTree wr, bool inLetExprBody) {
       Contract.Requires(lhss != null);
       Contract.Requires(constraint != null);
       Contract.Requires(bounds != null);
@@ -3673,6 +3718,7 @@ namespace Microsoft.Dafny.Compilers {
       var iterLimit = "_iterLimit_" + c;
 
       bool needIterLimit = lhss.Count != 1 && bounds.Exists(bnd => (bnd.Virtues & ComprehensionExpr.BoundedPool.PoolVirtues.Finite) == 0);
+      var site = DeclareAssignSuchThatSite(tok, wr);
       wr = CreateLabeledCode(doneLabel, false, wr);
       var wrOuter = wr;
       if (needIterLimit) {
@@ -3689,6 +3735,7 @@ namespace Microsoft.Dafny.Compilers {
         var tmpVar = ProtectedFreshId("_assign_such_that_");
         var wStmts = wr.Fork();
         var elementType = CompileCollection(bound, bv, inLetExprBody, true, null, out var collection, wStmts);
+        collection = WrapAssignSuchThatPool(collection, site, i);
         wr = CreateGuardedForeachLoop(tmpVar, elementType, bv, false, inLetExprBody, bv.Tok, collection, wr);
         if (needIterLimit) {
           var varName = $"{iterLimit}_{i}";
@@ -3705,7 +3752,7 @@ namespace Microsoft.Dafny.Compilers {
       TrExpr(constraint, guardWriter, inLetExprBody, wStmtsIf);
       EmitBreak(doneLabel, wBody);
       // Java compiler throws unreachable error when absurd statement is written after unbounded for-loop, so we don't write it then.
-      EmitAbsurd(string.Format("assign-such-that search produced no value (line {0})", debuginfoLine), wrOuter, needIterLimit);
+      EmitAbsurd(string.Format("assign-such-that search produced no value (line {0})", tok.line), wrOuter, needIterLimit);
     }
 
     protected interface ILvalue {
@@ -4722,7 +4769,7 @@ namespace Microsoft.Dafny.Compilers {
             foreach (var bv in e.BoundVars) {
               DeclareLocalVar(IdName(bv), bv.Type, bv.tok, false, PlaceboValue(bv.Type, wr, bv.tok, true), w);
             }
-            TrAssignSuchThat(new List<IVariable>(e.BoundVars).ConvertAll(bv => (IVariable)bv), e.RHSs[0], e.Constraint_Bounds, e.tok.line, w, inLetExprBody);
+            TrAssignSuchThat(new List<IVariable>(e.BoundVars).ConvertAll(bv => (IVariable)bv), e.RHSs[0], e.Constraint_Bounds, e.tok, w, inLetExprBody);
             EmitReturnExpr(e.Body, e.Body.Type, true, w);
           }
         }
@@ -4829,7 +4876,8 @@ namespace Microsoft.Dafny.Compilers {
           var tmpVar = ProtectedFreshId("_compr_");
           var wStmtsLoop = wr.Fork();
           var elementType = CompileCollection(bound, bv, inLetExprBody, true, null, out var collection, wStmtsLoop);
-          wr = CreateGuardedForeachLoop(tmpVar, elementType, bv, true, inLetExprBody, e.tok, collection, wr);
+          wr = CreateGuardedForeachLoop(tmpVar, elementType, bv, true, inLetExprBody, e.tok, collection, wr,
+            e.Type.AsSetType, i == 0 ? collectionName : null);
         }
         ConcreteSyntaxTree guardWriter;
         var thn = EmitIf(out guardWriter, false, wr);
@@ -4874,7 +4922,8 @@ namespace Microsoft.Dafny.Compilers {
           var tmpVar = ProtectedFreshId("_compr_");
           var wStmtsLoop = wr.Fork();
           var elementType = CompileCollection(bound, bv, inLetExprBody, true, null, out var collection, wStmtsLoop);
-          wr = CreateGuardedForeachLoop(tmpVar, elementType, bv, true, false, bv.tok, collection, wr);
+          wr = CreateGuardedForeachLoop(tmpVar, elementType, bv, true, false, bv.tok, collection, wr,
+            e.Type.AsMapType, i == 0 ? collection_name : null);
         }
         ConcreteSyntaxTree guardWriter;
         var thn = EmitIf(out guardWriter, false, wr);
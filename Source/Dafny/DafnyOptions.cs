@@ -92,6 +92,8 @@ namespace Microsoft.Dafny {
     public bool EnforcePrintEffects = false;
     public string DafnyPrintCompiledFile = null;
     public string CoverageLegendFile = null;
+    public bool CheckCancellation = false;
+    public bool ProfileCalls = false;
     public string MainMethod = null;
     public bool RunAllTests = false;
     public bool ForceCompile = false;
@@ -405,6 +407,14 @@ namespace Microsoft.Dafny {
             return true;
           }
 
+        case "checkCancellation":
+          CheckCancellation = true;
+          return true;
+
+        case "profileCalls":
+          ProfileCalls = true;
+          return true;
+
         case "noCheating": {
             int cheat = 0; // 0 is default, allows cheating
             if (ps.GetIntArgument(ref cheat, 2)) {
@@ -1486,6 +1496,17 @@ Exit code: 0 -- success; 1 -- invalid command-line; 2 -- parse or type errors;
     <file> a legend that gives a description of each
     source-location identifier used in the branch-coverage calls.
     (use - as <file> to print to console)
+/checkCancellation
+    (Go only) Check for cancellation on entry to each compiled method and
+    function and in each loop, so that a program run with the runtime's
+    Call stops once its context is done.  Without this option, such a
+    program only stops at the runtime's own checks, in quantifiers and
+    iterators.
+/profileCalls
+    (Go only) Report each call of a compiled method or function to the
+    runtime's call profiler, which counts the calls, times them and labels
+    CPU profiles with the name of the Dafny code running, while profiling
+    is enabled (see EnableProfiling and SetCallProfileFile in the runtime).
 /optimize     Produce optimized C# code, meaning:
       - passes /optimize flag to csc.exe.
 /optimizeResolution:<n>
@@ -76,6 +76,11 @@ public abstract class Compiler {
   /// Whether generated code can be compiled without being written to disk.
   /// </summary>
   public abstract bool SupportsInMemoryCompilation { get; }
+  /// <summary>
+  /// Whether a main method may take the program's command-line arguments, as a single <c>seq&lt;string&gt;</c>
+  /// parameter.
+  /// </summary>
+  public virtual bool SupportsMainArguments => false;
 
   /// <summary>
   /// Dafny features this compiler is known to not support.
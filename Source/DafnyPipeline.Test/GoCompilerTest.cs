@@ -0,0 +1,61 @@
+using System.Collections.Generic;
+using System.IO;
+using System.Linq;
+using Microsoft.Dafny;
+using Microsoft.Dafny.Compilers;
+using Xunit;
+
+namespace DafnyPipeline.Test {
+  // Main.Resolve has static shared state (TypeConstraint.ErrorsToBeReported for example)
+  // so we can't execute tests that use it in parallel.
+  [Collection("Singleton Test Collection - Resolution")]
+  public class GoCompilerTest {
+    private static string Compile(string programString, params string[] arguments) {
+      ErrorReporter reporter = new ConsoleErrorReporter();
+      var options = DafnyOptions.Create(arguments.Prepend("/compileTarget:go").ToArray());
+      DafnyOptions.Install(options);
+
+      ModuleDecl module = new LiteralModuleDecl(new DefaultModuleDecl(), null);
+      Microsoft.Dafny.Type.ResetScopes();
+      BuiltIns builtIns = new BuiltIns();
+      Parser.Parse(programString, "virtual", "virtual", module, builtIns, reporter);
+      var dafnyProgram = new Program("programName", module, builtIns, reporter);
+      Main.Resolve(dafnyProgram, reporter);
+      Assert.Equal(0, reporter.Count(ErrorLevel.Error));
+
+      var compiler = options.Compiler;
+      Assert.IsType<GoCompiler>(compiler);
+      compiler.OnPreCompile(reporter, new List<string>().AsReadOnly());
+      var output = new ConcreteSyntaxTree();
+      compiler.Compile(dafnyProgram, output);
+      var writer = new StringWriter();
+      output.Render(writer, 0, new WriterState(), new Queue<FileSyntax>(), compiler.TargetIndentSize);
+      return writer.ToString();
+    }
+
+    [Fact]
+    public void CollectionTypeDescriptorsWithoutElementTypeDescriptors() {
+      // T has no compiled value, so it has no type descriptor for those of seq<T> and map<T, seq<T>> to carry
+      var target = Compile(@"
+method Make<U(0)>() returns (u: U) { }
+method WithoutDescriptor<T(==)>() returns (s: seq<T>, m: map<T, seq<T>>) {
+  s := Make<seq<T>>();
+  m := Make<map<T, seq<T>>>();
+}
+method WithDescriptor<T(==,0)>() returns (s: seq<T>) {
+  s := Make<seq<T>>();
+}
+");
+      Assert.Contains("Make(_dafny.SeqType)", target);
+      Assert.Contains("Make(_dafny.MapType)", target);
+      Assert.Contains("Make(_dafny.SeqTypeOf(Type_T_))", target);
+    }
+
+    [Fact]
+    public void CallsAreProfiledOnlyWithProfileCalls() {
+      var program = "function Double(x: int): int { 2 * x }";
+      Assert.DoesNotContain("_dafny.ProfileCall(", Compile(program));
+      Assert.Contains("defer _dafny.ProfileCall(\"Double\")()", Compile(program, "/profileCalls"));
+    }
+  }
+}
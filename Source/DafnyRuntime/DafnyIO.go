@@ -0,0 +1,106 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+// Package DafnyIOExterns implements the extern module of the same name,
+// declared in DafnyIO.dfy, which provides file and console I/O to Dafny
+// programs compiled to Go.  Failures are reported through an isError result
+// and an error message rather than by halting.
+package DafnyIOExterns
+
+import (
+  "bufio"
+  _dafny "dafny"
+  "errors"
+  "io"
+  "os"
+  "strings"
+  "sync"
+)
+
+// ReadBytesFromFile reads the whole contents of the named file.
+func ReadBytesFromFile(path _dafny.Seq) (bool, _dafny.Seq, _dafny.Seq) {
+  bytes, err := os.ReadFile(path.ToGoString())
+  if err != nil {
+    return true, _dafny.SeqOfBytes(nil), errorMessage(err)
+  }
+  return false, _dafny.SeqOfBytes(bytes), _dafny.SeqOfString("")
+}
+
+// WriteBytesToFile writes to the named file, either replacing its contents or
+// appending to them, and creating it if need be.
+func WriteBytesToFile(path _dafny.Seq, bytes _dafny.Seq, append bool) (bool, _dafny.Seq) {
+  flags := os.O_WRONLY | os.O_CREATE
+  if append {
+    flags |= os.O_APPEND
+  } else {
+    flags |= os.O_TRUNC
+  }
+  file, err := os.OpenFile(path.ToGoString(), flags, 0666)
+  if err != nil {
+    return true, errorMessage(err)
+  }
+  _, err = file.Write(bytes.ToByteArray())
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  if err != nil {
+    return true, errorMessage(err)
+  }
+  return false, _dafny.SeqOfString("")
+}
+
+var stdinMu sync.Mutex
+var stdin = bufio.NewReader(os.Stdin)
+
+// ReadLineFromStdin reads a line from standard input, removing the line
+// terminator ("\n" or "\r\n").  At the end of the input, it reports isEof,
+// unless there's a final line without a terminator, which is returned first.
+func ReadLineFromStdin() (bool, bool, _dafny.Seq, _dafny.Seq) {
+  stdinMu.Lock()
+  defer stdinMu.Unlock()
+  // Make sure a prompt written without a newline shows up before blocking
+  _dafny.FlushOutput()
+  line, err := stdin.ReadString('\n')
+  if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+    if errors.Is(err, io.EOF) {
+      return false, true, _dafny.SeqOfString(""), _dafny.SeqOfString("")
+    }
+    return true, false, _dafny.SeqOfString(""), errorMessage(err)
+  }
+  line = strings.TrimSuffix(line, "\n")
+  line = strings.TrimSuffix(line, "\r")
+  return false, false, _dafny.SeqOfString(line), _dafny.SeqOfString("")
+}
+
+// WriteStringToConsole writes a string to standard error, or otherwise to the
+// same output as print statements.
+func WriteStringToConsole(s _dafny.Seq, toStderr bool) (bool, _dafny.Seq) {
+  var err error
+  if toStderr {
+    // Keep the order of output to the two streams
+    _dafny.FlushOutput()
+    _, err = io.WriteString(os.Stderr, s.ToGoString())
+  } else {
+    _, err = io.WriteString(_dafny.Output(), s.ToGoString())
+  }
+  if err != nil {
+    return true, errorMessage(err)
+  }
+  return false, _dafny.SeqOfString("")
+}
+
+// GetEnvironmentVariable looks up an environment variable.
+func GetEnvironmentVariable(name _dafny.Seq) (bool, _dafny.Seq) {
+  value, isSet := os.LookupEnv(name.ToGoString())
+  return isSet, _dafny.SeqOfString(value)
+}
+
+// SetExitCode sets the exit code with which the program will exit if its main
+// method returns normally.
+func SetExitCode(code _dafny.Int) {
+  _dafny.SetExitCode(code.Int())
+}
+
+func errorMessage(err error) _dafny.Seq {
+  return _dafny.SeqOfString(err.Error())
+}
@@ -0,0 +1,318 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+// Package DafnyProfiling records the branch coverage of a Dafny program
+// compiled to Go with a coverage legend (/coverage:<file>).  The generated code
+// calls CodeCoverage.Setup before Main, CodeCoverage.Record at every
+// instrumentation point, and CodeCoverage.TearDown once Main is done.  Points
+// reached before Setup (by the initialization of constants, say) are counted
+// once Setup is called.
+//
+// At teardown, a report of how many times each point was reached is written to
+// the file set by SetReportFile, or else to the file named by the
+// DAFNY_COVERAGE_REPORT environment variable, or else to standard error.  If
+// the legend can be read, the report describes the points with it, and if an
+// LCOV file is set by SetLCOVFile or named by DAFNY_COVERAGE_LCOV, the
+// coverage is also written there in LCOV format.  The legend is the file given
+// to the compiler, unless DAFNY_COVERAGE_LEGEND names another one.
+package DafnyProfiling
+
+import (
+  "bufio"
+  _dafny "dafny"
+  "fmt"
+  "io"
+  "os"
+  "regexp"
+  "sort"
+  "strconv"
+  "sync"
+  "sync/atomic"
+)
+
+// Coverage counts how many times each instrumentation point is reached.  It is
+// safe for concurrent use.
+type Coverage struct {
+  counts     atomic.Pointer[[]atomic.Uint64]
+  unknown    atomic.Uint64 // visits to points outside those set up
+  mu         sync.Mutex
+  early      map[int]uint64 // visits before Setup
+  legendFile string
+  reportFile string
+  lcovFile   string
+}
+
+// CodeCoverage is the Coverage that generated code records to.
+var CodeCoverage = &Coverage{}
+
+// Setup starts counting, from zero, for instrumentation points 0 to n - 1.
+// Visits recorded before Setup count too.
+func (c *Coverage) Setup(n int) {
+  counts := make([]atomic.Uint64, n)
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.counts.Store(&counts)
+  c.unknown.Store(0)
+  for id, visits := range c.early {
+    c.add(&counts, id, visits)
+  }
+  c.early = nil
+}
+
+// Record counts a visit to the given instrumentation point.  It always returns
+// true, so that it can be used within expressions.
+func (c *Coverage) Record(id int) bool {
+  if counts := c.counts.Load(); counts != nil {
+    c.add(counts, id, 1)
+  } else {
+    c.recordEarly(id)
+  }
+  return true
+}
+
+func (c *Coverage) add(counts *[]atomic.Uint64, id int, visits uint64) {
+  if 0 <= id && id < len(*counts) {
+    (*counts)[id].Add(visits)
+  } else {
+    c.unknown.Add(visits)
+  }
+}
+
+// recordEarly keeps a visit made before Setup for Setup to count.
+func (c *Coverage) recordEarly(id int) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  // Setup may have been called in the meantime
+  if counts := c.counts.Load(); counts != nil {
+    c.add(counts, id, 1)
+    return
+  }
+  if c.early == nil {
+    c.early = make(map[int]uint64)
+  }
+  c.early[id]++
+}
+
+// Counts returns how many times each instrumentation point has been reached.
+func (c *Coverage) Counts() []uint64 {
+  counts := c.counts.Load()
+  if counts == nil {
+    return nil
+  }
+  ans := make([]uint64, len(*counts))
+  for i := range *counts {
+    ans[i] = (*counts)[i].Load()
+  }
+  return ans
+}
+
+// SetLegendFile sets the legend file used to describe the instrumentation
+// points.  The generated code sets it to the one the compiler wrote.
+func (c *Coverage) SetLegendFile(path string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.legendFile = path
+}
+
+// SetReportFile sets the file that TearDown writes the report to, in place of
+// the one named by DAFNY_COVERAGE_REPORT.  An empty path restores the default.
+func (c *Coverage) SetReportFile(path string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.reportFile = path
+}
+
+// SetLCOVFile sets the file that TearDown writes the LCOV output to, in place
+// of the one named by DAFNY_COVERAGE_LCOV.  An empty path restores the default.
+func (c *Coverage) SetLCOVFile(path string) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.lcovFile = path
+}
+
+// setting returns the value of a setting, or else of the environment variable.
+func (c *Coverage) setting(value *string, env string) string {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if *value != "" {
+    return *value
+  }
+  return os.Getenv(env)
+}
+
+// TearDown writes the report, and the LCOV output if requested, as described
+// in the package documentation.  Problems are reported on standard error; they
+// don't halt the program.
+func (c *Coverage) TearDown() {
+  _dafny.FlushOutput()
+  legend, err := c.readLegend()
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "coverage: %v\n", err)
+  }
+  if path := c.setting(&c.reportFile, "DAFNY_COVERAGE_REPORT"); path != "" {
+    err = writeFile(path, func(w io.Writer) error {
+      return c.WriteReport(w, legend)
+    })
+  } else {
+    err = c.WriteReport(os.Stderr, legend)
+  }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "coverage: %v\n", err)
+  }
+  if path := c.setting(&c.lcovFile, "DAFNY_COVERAGE_LCOV"); path != "" && legend != nil {
+    err = writeFile(path, func(w io.Writer) error {
+      return c.WriteLCOV(w, legend)
+    })
+    if err != nil {
+      fmt.Fprintf(os.Stderr, "coverage: %v\n", err)
+    }
+  }
+}
+
+func (c *Coverage) readLegend() ([]LegendEntry, error) {
+  path := os.Getenv("DAFNY_COVERAGE_LEGEND")
+  if path == "" {
+    c.mu.Lock()
+    path = c.legendFile
+    c.mu.Unlock()
+  }
+  if path == "" {
+    return nil, nil
+  }
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  return ReadLegend(file)
+}
+
+func writeFile(path string, write func(w io.Writer) error) error {
+  file, err := os.Create(path)
+  if err != nil {
+    return err
+  }
+  w := bufio.NewWriter(file)
+  err = write(w)
+  if flushErr := w.Flush(); err == nil {
+    err = flushErr
+  }
+  if closeErr := file.Close(); err == nil {
+    err = closeErr
+  }
+  return err
+}
+
+// A LegendEntry describes an instrumentation point.
+type LegendEntry struct {
+  ID          int
+  File        string
+  Line, Col   int
+  Description string
+}
+
+var legendLine = regexp.MustCompile(`^(\d+): (.*?)\((\d+),(\d+)\): (.*)$`)
+
+// ReadLegend parses a legend file as written by the compiler, with lines of
+// the form "<id>: <file>(<line>,<col>): <description>".
+func ReadLegend(r io.Reader) ([]LegendEntry, error) {
+  var legend []LegendEntry
+  scanner := bufio.NewScanner(r)
+  for lineNo := 1; scanner.Scan(); lineNo++ {
+    m := legendLine.FindStringSubmatch(scanner.Text())
+    if m == nil {
+      return nil, fmt.Errorf("legend line %d is malformed: %q", lineNo, scanner.Text())
+    }
+    id, _ := strconv.Atoi(m[1])
+    line, _ := strconv.Atoi(m[3])
+    col, _ := strconv.Atoi(m[4])
+    legend = append(legend, LegendEntry{id, m[2], line, col, m[5]})
+  }
+  return legend, scanner.Err()
+}
+
+// WriteReport writes how many times each instrumentation point was reached,
+// one point per line, followed by a summary.  The points are described using
+// the legend, if it isn't nil.
+func (c *Coverage) WriteReport(w io.Writer, legend []LegendEntry) error {
+  counts := c.Counts()
+  descriptions := make(map[int]LegendEntry, len(legend))
+  for _, e := range legend {
+    descriptions[e.ID] = e
+  }
+  covered := 0
+  for id, n := range counts {
+    if n > 0 {
+      covered++
+    }
+    var err error
+    if e, ok := descriptions[id]; ok {
+      _, err = fmt.Fprintf(w, "%d: %s(%d,%d): %s: %d\n", id, e.File, e.Line, e.Col, e.Description, n)
+    } else {
+      _, err = fmt.Fprintf(w, "%d: %d\n", id, n)
+    }
+    if err != nil {
+      return err
+    }
+  }
+  if _, err := fmt.Fprintf(w, "Covered %d of %d points\n", covered, len(counts)); err != nil {
+    return err
+  }
+  if unknown := c.unknown.Load(); unknown > 0 {
+    _, err := fmt.Fprintf(w, "Also reached points not set up %d times\n", unknown)
+    return err
+  }
+  return nil
+}
+
+// WriteLCOV writes the coverage in LCOV format, joined against the legend.
+// Every instrumentation point becomes a branch (BRDA), and each line with
+// points is counted (DA) as often as its points were reached in total.
+func (c *Coverage) WriteLCOV(w io.Writer, legend []LegendEntry) error {
+  counts := c.Counts()
+  byFile := make(map[string][]LegendEntry)
+  var files []string
+  for _, e := range legend {
+    if _, ok := byFile[e.File]; !ok {
+      files = append(files, e.File)
+    }
+    byFile[e.File] = append(byFile[e.File], e)
+  }
+  sort.Strings(files)
+
+  bw := bufio.NewWriter(w)
+  for _, file := range files {
+    entries := byFile[file]
+    sort.SliceStable(entries, func(i, j int) bool {
+      return entries[i].Line < entries[j].Line
+    })
+    fmt.Fprintf(bw, "TN:\nSF:%s\n", file)
+    lineCounts := make(map[int]uint64)
+    var lines []int
+    branchesHit := 0
+    for _, e := range entries {
+      var n uint64
+      if 0 <= e.ID && e.ID < len(counts) {
+        n = counts[e.ID]
+      }
+      if n > 0 {
+        branchesHit++
+      }
+      if _, ok := lineCounts[e.Line]; !ok {
+        lines = append(lines, e.Line)
+      }
+      lineCounts[e.Line] += n
+      fmt.Fprintf(bw, "BRDA:%d,0,%d,%d\n", e.Line, e.ID, n)
+    }
+    fmt.Fprintf(bw, "BRF:%d\nBRH:%d\n", len(entries), branchesHit)
+    linesHit := 0
+    for _, line := range lines {
+      if lineCounts[line] > 0 {
+        linesHit++
+      }
+      fmt.Fprintf(bw, "DA:%d,%d\n", line, lineCounts[line])
+    }
+    fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), linesHit)
+  }
+  return bw.Flush()
+}
@@ -0,0 +1,101 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+package DafnyProfiling
+
+import (
+  "os"
+  "path/filepath"
+  "reflect"
+  "strings"
+  "testing"
+)
+
+func TestRecord(t *testing.T) {
+  c := &Coverage{}
+  c.Setup(3)
+  c.Record(0)
+  c.Record(2)
+  c.Record(2)
+  if got, want := c.Counts(), []uint64{1, 0, 2}; !reflect.DeepEqual(got, want) {
+    t.Errorf("Counts() = %v, want %v", got, want)
+  }
+}
+
+func TestRecordBeforeSetup(t *testing.T) {
+  c := &Coverage{}
+  c.Record(1)
+  c.Record(1)
+  c.Record(5)
+  c.Setup(2)
+  c.Record(0)
+  if got, want := c.Counts(), []uint64{1, 2}; !reflect.DeepEqual(got, want) {
+    t.Errorf("Counts() = %v, want %v", got, want)
+  }
+  var report strings.Builder
+  if err := c.WriteReport(&report, nil); err != nil {
+    t.Fatal(err)
+  }
+  if want := "Also reached points not set up 1 times\n"; !strings.HasSuffix(report.String(), want) {
+    t.Errorf("report = %q, want it to end with %q", report.String(), want)
+  }
+}
+
+func TestWriteReport(t *testing.T) {
+  c := &Coverage{}
+  c.Setup(2)
+  c.Record(1)
+  legend := []LegendEntry{{0, "a.dfy", 3, 5, "then branch"}}
+  var report strings.Builder
+  if err := c.WriteReport(&report, legend); err != nil {
+    t.Fatal(err)
+  }
+  want := "0: a.dfy(3,5): then branch: 0\n1: 1\nCovered 1 of 2 points\n"
+  if report.String() != want {
+    t.Errorf("report = %q, want %q", report.String(), want)
+  }
+}
+
+func TestTearDownWritesToConfiguredFiles(t *testing.T) {
+  dir := t.TempDir()
+  legendFile := filepath.Join(dir, "legend.txt")
+  if err := os.WriteFile(legendFile, []byte("0: a.dfy(3,5): then branch\n"), 0o644); err != nil {
+    t.Fatal(err)
+  }
+  c := &Coverage{}
+  c.SetLegendFile(legendFile)
+  c.SetReportFile(filepath.Join(dir, "report.txt"))
+  c.SetLCOVFile(filepath.Join(dir, "coverage.lcov"))
+  c.Setup(1)
+  c.Record(0)
+  c.TearDown()
+
+  report, err := os.ReadFile(filepath.Join(dir, "report.txt"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if want := "0: a.dfy(3,5): then branch: 1\nCovered 1 of 1 points\n"; string(report) != want {
+    t.Errorf("report = %q, want %q", report, want)
+  }
+  lcov, err := os.ReadFile(filepath.Join(dir, "coverage.lcov"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !strings.Contains(string(lcov), "SF:a.dfy\nBRDA:3,0,0,1\n") {
+    t.Errorf("LCOV output = %q, want a branch of a.dfy reached once", lcov)
+  }
+}
+
+func TestReadLegend(t *testing.T) {
+  legend, err := ReadLegend(strings.NewReader("0: a.dfy(3,5): then branch\n1: dir/b.dfy(10,1): entry\n"))
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := []LegendEntry{{0, "a.dfy", 3, 5, "then branch"}, {1, "dir/b.dfy", 10, 1, "entry"}}
+  if !reflect.DeepEqual(legend, want) {
+    t.Errorf("ReadLegend = %v, want %v", legend, want)
+  }
+  if _, err := ReadLegend(strings.NewReader("nonsense\n")); err == nil {
+    t.Error("ReadLegend accepted a malformed line")
+  }
+}
@@ -4,10 +4,29 @@
 package dafny
 
 import (
+  "bufio"
+  "bytes"
+  "context"
   "fmt"
+  "io"
+  "iter"
+  "math"
   big "math/big"
+  "math/bits"
+  "math/rand"
+  randv2 "math/rand/v2"
+  "os"
   refl "reflect"
   "runtime"
+  "runtime/pprof"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "text/tabwriter"
+  "time"
+  "unsafe"
 )
 
 /******************************************************************************
@@ -41,6 +60,7 @@ func AreEqual(x, y interface{}) bool {
   case EqualsGeneric:
     return x.EqualsGeneric(y)
   default:
+    runtimeStats.deepEqualFallbacks.add(1)
     return refl.DeepEqual(x, y)
   }
 }
@@ -83,11 +103,6 @@ func String(x interface{}) string {
   return fmt.Sprint(x)
 }
 
-// Print prints the given value using fmt.Print, formatted using String.
-func Print(x interface{}) {
-  fmt.Print(String(x))
-}
-
 // SetFinalizer is a re-export of runtime.SetFinalizer.  Included here so that
 // only this module needs to be imported by every Dafny module.
 func SetFinalizer(x interface{}, f interface{}) {
@@ -95,314 +110,2449 @@ func SetFinalizer(x interface{}, f interface{}) {
 }
 
 /******************************************************************************
- * Run-time type descriptors (RTDs)
+ * Goroutine state
  ******************************************************************************/
 
-// A TypeDescriptor has the ability to produce a default value for an associated type.
-type TypeDescriptor interface {
-  Default() interface{}
+// Dafny code run by RedirectOutput, Call or ProfileCall has state of its own:
+// its context, where its output goes and the profiled call in progress.  Since
+// compiled code doesn't pass this state around, it's kept with the goroutine's
+// profiler labels, which goroutines that the code starts inherit.  Entering a
+// state gives the goroutine new labels, merged with the labels it had, and
+// looks the state up by them; code that sets its goroutine's labels itself, as
+// pprof.Do does, runs without the state.
+
+//go:linkname getProfLabel runtime/pprof.runtime_getProfLabel
+func getProfLabel() unsafe.Pointer
+
+//go:linkname setProfLabel runtime/pprof.runtime_setProfLabel
+func setProfLabel(labels unsafe.Pointer)
+
+// A goroutineState is the state of the Dafny code run by a goroutine.
+type goroutineState struct {
+  ctx    context.Context // carries the goroutine's labels
+  call   *call           // nil outside of Call
+  output *redirect       // nil unless the output is redirected
+  frame  *profileFrame   // the profiled call in progress, if any
 }
 
-func CreateStandardTypeDescriptor(value interface{}) TypeDescriptor {
-  return standardTypeDescriptor{value}
+var states sync.Map        // label pointer -> *goroutineState
+var stateCount atomic.Int32 // number of entries in states
+
+// currentState returns the goroutine's state, or nil if it has none.
+func currentState() *goroutineState {
+  if stateCount.Load() == 0 {
+    return nil
+  }
+  if s, ok := states.Load(getProfLabel()); ok {
+    return s.(*goroutineState)
+  }
+  return nil
 }
 
-type standardTypeDescriptor struct {
-  defaultValue interface{}
+// enterState gives the goroutine a copy of its state, changed by update and
+// with the given labels added, until the returned function is called.
+func enterState(labels pprof.LabelSet, update func(s *goroutineState)) (exit func()) {
+  prev := getProfLabel()
+  s := &goroutineState{ctx: context.Background()}
+  if cur := currentState(); cur != nil {
+    *s = *cur
+  }
+  update(s)
+  s.ctx = pprof.WithLabels(labelsContext{s.ctx, prev}, labels)
+  pprof.SetGoroutineLabels(s.ctx)
+  key := getProfLabel()
+  states.Store(key, s)
+  stateCount.Add(1)
+  return func() {
+    states.Delete(key)
+    stateCount.Add(-1)
+    setProfLabel(prev)
+  }
 }
 
-func (rtd standardTypeDescriptor) Default() interface{} {
-  return rtd.defaultValue
+// A labelsContext is a context whose profiler labels are the given ones,
+// rather than its parent's.  The runtime stores a goroutine's labels as the
+// value that pprof keeps them under in a context, and labelKey and
+// labelMapType, found by probing pprof.WithLabels, let that value be rebuilt.
+type labelsContext struct {
+  context.Context
+  labels unsafe.Pointer
 }
 
-// IntType is the RTD for int
-var IntType = CreateStandardTypeDescriptor(Zero)
+func (c labelsContext) Value(key interface{}) interface{} {
+  if key == labelKey && labelMapType != nil {
+    if c.labels == nil {
+      return nil
+    }
+    return refl.NewAt(labelMapType.Elem(), c.labels).Interface()
+  }
+  return c.Context.Value(key)
+}
 
-// BoolType is the RTD of bool
-var BoolType = CreateStandardTypeDescriptor(false)
+// A keyProbe records the key that a context is asked for a value by.
+type keyProbe struct {
+  context.Context
+  key interface{}
+}
 
-// CharType is the RTD of char
-var CharType = CreateStandardTypeDescriptor(Char('D'))  // See CharType.DefaultValue in Dafny source code
+func (p *keyProbe) Value(key interface{}) interface{} {
+  p.key = key
+  return nil
+}
 
-// RealType is the RTD for real
-var RealType = CreateStandardTypeDescriptor(ZeroReal)
+var labelKey, labelMapType = func() (interface{}, refl.Type) {
+  probe := &keyProbe{Context: context.Background()}
+  ctx := pprof.WithLabels(probe, pprof.Labels("dafny", ""))
+  t := refl.TypeOf(ctx.Value(probe.key))
+  if t == nil || t.Kind() != refl.Ptr {
+    return nil, nil
+  }
+  return probe.key, t
+}()
 
-// Int64Type is the RTD of int64.
-var Int64Type = CreateStandardTypeDescriptor(int64(0))
+// labelsOf returns the profiler labels of a context.
+func labelsOf(ctx context.Context) pprof.LabelSet {
+  var kvs []string
+  pprof.ForLabels(ctx, func(key, value string) bool {
+    kvs = append(kvs, key, value)
+    return true
+  })
+  return pprof.Labels(kvs...)
+}
 
-// PossiblyNullType is the RTD of any possibly null reference type
-var PossiblyNullType = CreateStandardTypeDescriptor((*interface{})(nil))
+/******************************************************************************
+ * Output
+ ******************************************************************************/
 
-// Uint8Type is the RTD of uint8
-var Uint8Type = CreateStandardTypeDescriptor(uint8(0))
+// Print writes to an output sink, which is os.Stdout unless set otherwise by
+// SetOutput.  Code run by RedirectOutput or CaptureOutput, and goroutines it
+// starts, print to the writer given to that instead.
+//
+// The sink can be buffered for throughput, in which case FlushOutput must be
+// called before the program exits.  Compiled programs do this on exit and on
+// halt, in CatchHalt.
 
-// Uint16Type is the RTD of uint16
-var Uint16Type = CreateStandardTypeDescriptor(uint16(0))
+var outputMu sync.Mutex
+var outputSink io.Writer = os.Stdout
+var outputBuffer *bufio.Writer // non-nil when output is buffered
 
-// Uint32Type is the RTD of uint32
-var Uint32Type = CreateStandardTypeDescriptor(uint32(0))
+// A redirect is where the output of code run by RedirectOutput goes.
+type redirect struct {
+  mu sync.Mutex
+  w  io.Writer
+}
 
-// Uint64Type is the RTD of uint64
-var Uint64Type = CreateStandardTypeDescriptor(uint64(0))
+// Print prints the given value, formatted using String, to the output sink.
+func Print(x interface{}) {
+  writeOutput(String(x))
+}
 
-// SetType is the RTD for sets
-var SetType = CreateStandardTypeDescriptor(EmptySet)
+func writeOutput(s string) {
+  if state := currentState(); state != nil && state.output != nil {
+    state.output.mu.Lock()
+    defer state.output.mu.Unlock()
+    io.WriteString(state.output.w, s)
+    return
+  }
+  outputMu.Lock()
+  defer outputMu.Unlock()
+  if outputBuffer != nil {
+    outputBuffer.WriteString(s)
+  } else {
+    io.WriteString(outputSink, s)
+  }
+}
 
-// MultiSetType is the RTD for multisets
-var MultiSetType = CreateStandardTypeDescriptor(EmptyMultiSet)
+// SetOutput sets the writer that Print writes to outside of RedirectOutput,
+// returning the previous one.  Output buffered for the previous writer is
+// flushed first.
+func SetOutput(w io.Writer) io.Writer {
+  outputMu.Lock()
+  defer outputMu.Unlock()
+  prev := outputSink
+  if outputBuffer != nil {
+    outputBuffer.Flush()
+    outputBuffer = bufio.NewWriterSize(w, outputBuffer.Size())
+  }
+  outputSink = w
+  return prev
+}
 
-// SeqType is the RTD for sequences
-var SeqType = CreateStandardTypeDescriptor(EmptySeq)
+// SetOutputBuffering buffers the output with a buffer of the given size, or
+// turns buffering off (after flushing) if the size isn't positive.
+func SetOutputBuffering(size int) {
+  outputMu.Lock()
+  defer outputMu.Unlock()
+  if outputBuffer != nil {
+    outputBuffer.Flush()
+    outputBuffer = nil
+  }
+  if size > 0 {
+    outputBuffer = bufio.NewWriterSize(outputSink, size)
+  }
+}
 
-// MapType is the RTD for maps
-var MapType = CreateStandardTypeDescriptor(EmptyMap)
+// FlushOutput writes out any buffered output.
+func FlushOutput() error {
+  outputMu.Lock()
+  defer outputMu.Unlock()
+  if outputBuffer != nil {
+    return outputBuffer.Flush()
+  }
+  return nil
+}
+
+// Output returns a writer to the output sink, for use by external code that
+// wants its output to go wherever Print's does.  Where that is depends on the
+// goroutine writing, not the one that called Output.
+func Output() io.Writer {
+  return sharedOutput{}
+}
+
+type sharedOutput struct{}
+
+func (sharedOutput) Write(p []byte) (int, error) {
+  writeOutput(string(p))
+  return len(p), nil
+}
+
+// RedirectOutput calls f with its output, and that of goroutines it starts,
+// sent to w.  Writes to w are serialized.  Redirections nest, and ones made
+// concurrently by different goroutines keep their output apart.
+func RedirectOutput(w io.Writer, f func()) {
+  defer enterState(pprof.Labels(), func(s *goroutineState) {
+    s.output = &redirect{w: w}
+  })()
+  f()
+}
+
+// CaptureOutput calls f and returns what it printed, rather than printing it.
+func CaptureOutput(f func()) string {
+  w := &lockedBuffer{}
+  RedirectOutput(w, f)
+  return w.String()
+}
+
+// A lockedBuffer is a bytes.Buffer that can be written to concurrently.
+type lockedBuffer struct {
+  mu  sync.Mutex
+  buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.String()
+}
 
 /******************************************************************************
- * Trait parent information
+ * Cancellation
  ******************************************************************************/
 
-// Every class gets compiled to have a ParentTraits_ method, which returns the
-// list of Dafny parent traits (including transitive parent traits). This is
-// used to determine, at run time, if a given object satisfies a particular trait.
-// While it is unusual that this information is needed, it is needed in a situation
-// like
-//   var s: set<UberTrait> := ...
-//   // the following line requires run-time check that t (of type UberTrait) is a Trait
-//   var ts := set t: Trait | t in s;
-// A more straightforward situation is the expression
-//   x is Trait
+// Dafny code run by Call has a context, and stops once the context is done:
+// the runtime's iterators and quantifiers, as well as compiled methods,
+// functions and loops if compiled with /checkCancellation, check for
+// cancellation and raise a CancellationHalt.  A check costs an atomic load
+// while no running call is canceled.
+//
+// The context is part of the goroutine's state, so calls made concurrently
+// from different goroutines are independent, and goroutines started by the
+// Dafny code share its context.
 
-type TraitID struct {
-  dummy byte
+// A CancellationHalt is the halt raised by Dafny code whose context is done.
+// Unlike other halts, it isn't a string, so that Dafny code can't recover from
+// it.
+type CancellationHalt struct {
+  Err error // the context's error
+}
+
+func (h CancellationHalt) String() string {
+  return "canceled: " + h.Err.Error()
+}
+
+// A HaltError is the error returned by Call when the code halts other than by
+// being canceled.
+type HaltError struct {
+  Value interface{} // what the code panicked with
+}
+
+func (e *HaltError) Error() string {
+  return fmt.Sprint("[Program halted] ", e.Value)
+}
+
+// A call is the state of a run of Dafny code by Call.
+type call struct {
+  ctx    context.Context
+  status atomic.Int32 // callRunning, callCanceled or callFinished
+}
+
+const (
+  callRunning = iota
+  callCanceled
+  callFinished
+)
+
+// pendingCancellations counts the calls that are canceled but still running,
+// so that CheckCanceled needn't look up its goroutine's call otherwise.
+var pendingCancellations atomic.Int32
+
+func (c *call) cancel() {
+  if c.status.CompareAndSwap(callRunning, callCanceled) {
+    pendingCancellations.Add(1)
+  }
+}
+
+func (c *call) finish() {
+  if c.status.Swap(callFinished) == callCanceled {
+    pendingCancellations.Add(-1)
+  }
+}
+
+// Call calls f, which runs Dafny code, with ctx as the code's context.  It
+// returns nil if f returns normally, ctx.Err() (context.Canceled or
+// context.DeadlineExceeded) if f was stopped because ctx is done, and a
+// *HaltError if f halted otherwise.
+//
+// Calls nest: the inner call's code has its own context, and keeps the output
+// redirection of the outer call.  The context's profiler labels are added to
+// the goroutine's.
+func Call(ctx context.Context, f func()) (err error) {
+  if err := ctx.Err(); err != nil {
+    return err
+  }
+
+  c := &call{ctx: ctx}
+  defer enterState(labelsOf(ctx), func(s *goroutineState) {
+    s.ctx = ctx
+    s.call = c
+  })()
+  stop := context.AfterFunc(ctx, c.cancel)
+  defer func() {
+    stop()
+    c.finish()
+  }()
+
+  defer func() {
+    if r := recover(); r != nil {
+      if h, ok := r.(CancellationHalt); ok {
+        err = h.Err
+      } else {
+        err = &HaltError{r}
+      }
+    }
+  }()
+  f()
+  return nil
+}
+
+// Context returns the context of the Dafny code being run by Call, or
+// context.Background() outside of Call.  Either way, it carries the
+// goroutine's profiler labels.
+func Context() context.Context {
+  if s := currentState(); s != nil {
+    return s.ctx
+  }
+  return context.Background()
+}
+
+// CheckCanceled raises a CancellationHalt if the context of the Dafny code
+// being run by Call is done.
+func CheckCanceled() {
+  if pendingCancellations.Load() == 0 {
+    return
+  }
+  if s := currentState(); s != nil && s.call != nil && s.call.status.Load() == callCanceled {
+    panic(CancellationHalt{s.call.ctx.Err()})
+  }
+}
+
+// HaltMessage returns the message of a halt recovered by compiled code.  A
+// CancellationHalt is raised again instead, since it isn't to be recovered
+// from.
+func HaltMessage(r interface{}) Seq {
+  switch r := r.(type) {
+  case CancellationHalt:
+    panic(r)
+  case string:
+    return SeqOfString(r)
+  default:
+    return SeqOfString(fmt.Sprint(r))
+  }
+}
+
+/******************************************************************************
+ * Hashing
+ ******************************************************************************/
+
+// A Hashable can compute a hash of itself that agrees with its EqualsGeneric
+// method: equal values must have equal hashes.
+type Hashable interface {
+  Hash() uint64
+}
+
+// Hash computes a hash of any value that agrees with AreEqual.  Values of the
+// runtime's own types and of native scalar types are hashed by content, and
+// other types can take part by implementing Hashable.  All remaining values
+// (including datatypes and references) hash to the same bucket, which is
+// always safe but makes hash-indexed lookups of them linear.
+func Hash(x interface{}) uint64 {
+  if IsDafnyNull(x) {
+    return 0
+  }
+  switch x := x.(type) {
+  case Hashable:
+    return x.Hash()
+  case Int:
+    return x.hash()
+  case Real:
+    return hashMix(x.Num().hash(), x.Denom().hash())
+  case Char:
+    return hashUint64(uint64(x))
+  case bool:
+    if x {
+      return hashUint64(1)
+    }
+    return hashUint64(2)
+  case Seq:
+    return hashSlice(x.contents)
+  case Tuple:
+    return hashSlice(x.contents)
+  case Set:
+    return x.hash()
+  case MultiSet:
+    return x.hash()
+  case Map:
+    return x.hash()
+  case string:
+    return hashString(x)
+  case int:
+    return hashUint64(uint64(x))
+  case int8:
+    return hashUint64(uint64(x))
+  case int16:
+    return hashUint64(uint64(x))
+  case int32:
+    return hashUint64(uint64(x))
+  case int64:
+    return hashUint64(uint64(x))
+  case uint:
+    return hashUint64(uint64(x))
+  case uint8:
+    return hashUint64(uint64(x))
+  case uint16:
+    return hashUint64(uint64(x))
+  case uint32:
+    return hashUint64(uint64(x))
+  case uint64:
+    return hashUint64(x)
+  default:
+    return 0
+  }
+}
+
+// hashUint64 scrambles the bits of a word (this is the finalizer of
+// SplitMix64).
+func hashUint64(x uint64) uint64 {
+  x ^= x >> 30
+  x *= 0xbf58476d1ce4e5b9
+  x ^= x >> 27
+  x *= 0x94d049bb133111eb
+  x ^= x >> 31
+  return x
+}
+
+// hashMix combines two hashes in an order-dependent way.
+func hashMix(h1, h2 uint64) uint64 {
+  return hashUint64(h1*31 + h2)
+}
+
+func hashString(s string) uint64 {
+  h := uint64(14695981039346656037) // FNV-1a
+  for i := 0; i < len(s); i++ {
+    h ^= uint64(s[i])
+    h *= 1099511628211
+  }
+  return h
+}
+
+func hashSlice(values []interface{}) uint64 {
+  h := hashUint64(uint64(len(values)))
+  for _, v := range values {
+    h = hashMix(h, Hash(v))
+  }
+  return h
+}
+
+func (i Int) hash() uint64 {
+  if i.impl == nil {
+    // A zero-valued Int, as in a zero-valued datatype field, counts as zero
+    return hashUint64(0)
+  }
+  if i.impl.IsInt64() {
+    return hashUint64(uint64(i.impl.Int64()))
+  }
+  h := hashUint64(uint64(i.impl.Sign()))
+  for _, w := range i.impl.Bits() {
+    h = hashMix(h, uint64(w))
+  }
+  return h
+}
+
+func (set Set) hash() uint64 {
+  // Sum the elements' hashes so that the order doesn't matter
+  h := uint64(0)
+  for _, v := range set.elements() {
+    h += Hash(v)
+  }
+  return hashUint64(h)
+}
+
+func (mset MultiSet) hash() uint64 {
+  h := uint64(0)
+  for _, e := range mset.elts {
+    h += Hash(e.value) * hashUint64(e.count.Int().hash())
+  }
+  return hashUint64(h)
+}
+
+func (m Map) hash() uint64 {
+  h := uint64(0)
+  for _, e := range m.elts {
+    h += hashMix(Hash(e.key), Hash(e.value))
+  }
+  return hashUint64(h)
+}
+
+/******************************************************************************
+ * Ordering
+ ******************************************************************************/
+
+// An Ordered value knows how to compare itself to another value of the same
+// type, returning -1, 0, or 1 as for Compare.
+type Ordered interface {
+  CompareTo(other interface{}) int
+}
+
+// Compare orders any two values, returning -1 if x comes before y, 0 if they
+// are equal (according to AreEqual), and 1 if x comes after y.  The order is
+// total: values of different kinds are ordered by kind (null, bool, char, int,
+// real, native numbers, strings, sequences, tuples, sets, multisets, maps,
+// arrays, then everything else), and values of the same kind as follows:
+//
+//   - numbers and characters by value, and booleans with false first;
+//   - sequences, tuples, and arrays lexicographically;
+//   - sets and multisets by their sorted elements, and maps by their sorted
+//     keys and then by the corresponding values;
+//   - datatype values by constructor name and then by their fields in order;
+//   - values implementing Ordered by their CompareTo method.
+//
+// References to objects are ordered by address, which is consistent within a
+// run but not from one run to the next.
+func Compare(x, y interface{}) int {
+  kx, ky := orderKind(x), orderKind(y)
+  if kx != ky {
+    return cmpInts(kx, ky)
+  }
+  switch kx {
+  case orderNull:
+    return 0
+  case orderBool:
+    return cmpBools(x.(bool), y.(bool))
+  case orderChar:
+    return cmpInts(int(x.(Char)), int(y.(Char)))
+  case orderInt:
+    return x.(Int).Cmp(y.(Int))
+  case orderReal:
+    return x.(Real).Cmp(y.(Real))
+  case orderNative:
+    return compareNative(refl.ValueOf(x), refl.ValueOf(y))
+  case orderString:
+    return cmpStrings(x.(string), y.(string))
+  case orderSeq:
+    return compareSlices(x.(Seq).contents, y.(Seq).contents)
+  case orderTuple:
+    return compareSlices(x.(Tuple).contents, y.(Tuple).contents)
+  case orderSet:
+    return compareSlices(sortedValues(asSet(x).elements()), sortedValues(asSet(y).elements()))
+  case orderMultiSet:
+    return compareSlices(sortedValues(multiSetPairs(x.(MultiSet))), sortedValues(multiSetPairs(y.(MultiSet))))
+  case orderMap:
+    return compareSlices(sortedValues(mapPairs(asMap(x))), sortedValues(mapPairs(asMap(y))))
+  case orderArray:
+    a, b := x.(*Array), y.(*Array)
+    if c := compareIntSlices(a.dims, b.dims); c != 0 {
+      return c
+    }
+    return compareSlices(a.contents, b.contents)
+  default:
+    if xo, ok := x.(Ordered); ok && refl.TypeOf(x) == refl.TypeOf(y) {
+      return xo.CompareTo(y)
+    }
+    return compareReflect(refl.ValueOf(x), refl.ValueOf(y))
+  }
+}
+
+const (
+  orderNull = iota
+  orderBool
+  orderChar
+  orderInt
+  orderReal
+  orderNative
+  orderString
+  orderSeq
+  orderTuple
+  orderSet
+  orderMultiSet
+  orderMap
+  orderArray
+  orderOther
+)
+
+func orderKind(x interface{}) int {
+  if IsDafnyNull(x) {
+    return orderNull
+  }
+  switch x.(type) {
+  case bool:
+    return orderBool
+  case Char:
+    return orderChar
+  case Int:
+    return orderInt
+  case Real:
+    return orderReal
+  case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+    return orderNative
+  case string:
+    return orderString
+  case Seq:
+    return orderSeq
+  case Tuple:
+    return orderTuple
+  case Set, SortedSet:
+    return orderSet
+  case MultiSet:
+    return orderMultiSet
+  case Map, SortedMap:
+    return orderMap
+  case *Array:
+    return orderArray
+  default:
+    return orderOther
+  }
+}
+
+func cmpInts(i, j int) int {
+  switch {
+  case i < j:
+    return -1
+  case i > j:
+    return 1
+  default:
+    return 0
+  }
+}
+
+func cmpBools(a, b bool) int {
+  switch {
+  case a == b:
+    return 0
+  case b:
+    return -1
+  default:
+    return 1
+  }
+}
+
+func cmpStrings(a, b string) int {
+  switch {
+  case a < b:
+    return -1
+  case a > b:
+    return 1
+  default:
+    return 0
+  }
+}
+
+func compareSlices(s1, s2 []interface{}) int {
+  for i := 0; i < len(s1) && i < len(s2); i++ {
+    if c := Compare(s1[i], s2[i]); c != 0 {
+      return c
+    }
+  }
+  return cmpInts(len(s1), len(s2))
+}
+
+func compareIntSlices(s1, s2 []int) int {
+  for i := 0; i < len(s1) && i < len(s2); i++ {
+    if c := cmpInts(s1[i], s2[i]); c != 0 {
+      return c
+    }
+  }
+  return cmpInts(len(s1), len(s2))
+}
+
+// compareNative compares native numbers by value, and values of different
+// types that are equal by type name (since AreEqual doesn't equate them).
+func compareNative(x, y refl.Value) int {
+  var c int
+  switch {
+  case x.CanInt() && y.CanInt():
+    c = cmpInt64s(x.Int(), y.Int())
+  case x.CanUint() && y.CanUint():
+    c = cmpUint64s(x.Uint(), y.Uint())
+  case x.CanInt() && y.CanUint():
+    if x.Int() < 0 {
+      c = -1
+    } else {
+      c = cmpUint64s(uint64(x.Int()), y.Uint())
+    }
+  case x.CanUint() && y.CanInt():
+    c = -compareNative(y, x)
+  default:
+    c = nativeFloat(x).Cmp(nativeFloat(y))
+  }
+  if c != 0 {
+    return c
+  }
+  return cmpStrings(x.Type().String(), y.Type().String())
+}
+
+func nativeFloat(v refl.Value) *big.Float {
+  switch {
+  case v.CanInt():
+    return new(big.Float).SetInt64(v.Int())
+  case v.CanUint():
+    return new(big.Float).SetUint64(v.Uint())
+  default:
+    f := v.Float()
+    if math.IsNaN(f) {
+      // Put NaN before everything else so the order stays total
+      return big.NewFloat(math.Inf(-1))
+    }
+    return big.NewFloat(f)
+  }
+}
+
+func cmpInt64s(i, j int64) int {
+  switch {
+  case i < j:
+    return -1
+  case i > j:
+    return 1
+  default:
+    return 0
+  }
+}
+
+func cmpUint64s(i, j uint64) int {
+  switch {
+  case i < j:
+    return -1
+  case i > j:
+    return 1
+  default:
+    return 0
+  }
+}
+
+// sortedValues returns a sorted copy of the given values.
+func sortedValues(values []interface{}) []interface{} {
+  sorted := make([]interface{}, len(values))
+  copy(sorted, values)
+  sort.SliceStable(sorted, func(i, j int) bool {
+    return Compare(sorted[i], sorted[j]) < 0
+  })
+  return sorted
+}
+
+func multiSetPairs(mset MultiSet) []interface{} {
+  pairs := make([]interface{}, len(mset.elts))
+  for i, e := range mset.elts {
+    pairs[i] = TupleOf(e.value, e.count.Int())
+  }
+  return pairs
+}
+
+func mapPairs(m Map) []interface{} {
+  pairs := make([]interface{}, len(m.elts))
+  for i, e := range m.elts {
+    pairs[i] = TupleOf(e.key, e.value)
+  }
+  return pairs
+}
+
+// compareReflect orders values of arbitrary types, such as datatypes, using
+// reflection.  Values of different types are ordered by type name.
+func compareReflect(x, y refl.Value) int {
+  if !x.IsValid() || !y.IsValid() {
+    return cmpBools(x.IsValid(), y.IsValid())
+  }
+  if x.Type() != y.Type() {
+    return cmpStrings(x.Type().String(), y.Type().String())
+  }
+  if x.CanInterface() && y.CanInterface() {
+    // Runtime values, such as the Ints and Sets held by datatypes, have an
+    // order of their own, which doesn't depend on their representation
+    xi, yi := x.Interface(), y.Interface()
+    if _, ok := xi.(Ordered); ok || orderKind(xi) != orderOther {
+      return Compare(xi, yi)
+    }
+  }
+
+  switch x.Kind() {
+  case refl.Bool:
+    return cmpBools(x.Bool(), y.Bool())
+  case refl.Int, refl.Int8, refl.Int16, refl.Int32, refl.Int64,
+    refl.Uint, refl.Uint8, refl.Uint16, refl.Uint32, refl.Uint64, refl.Uintptr,
+    refl.Float32, refl.Float64:
+    return compareNative(x, y)
+  case refl.String:
+    return cmpStrings(x.String(), y.String())
+  case refl.Interface:
+    if x.IsNil() || y.IsNil() {
+      return cmpBools(!x.IsNil(), !y.IsNil())
+    }
+    return compareReflect(x.Elem(), y.Elem())
+  case refl.Struct:
+    // A datatype value is a struct embedding the constructor's struct (an
+    // interface), so this compares constructors by name and then fields
+    for i := 0; i < x.NumField(); i++ {
+      if c := compareReflect(x.Field(i), y.Field(i)); c != 0 {
+        return c
+      }
+    }
+    return 0
+  case refl.Slice, refl.Array:
+    for i := 0; i < x.Len() && i < y.Len(); i++ {
+      if c := compareReflect(x.Index(i), y.Index(i)); c != 0 {
+        return c
+      }
+    }
+    return cmpInts(x.Len(), y.Len())
+  case refl.Ptr:
+    if x.IsNil() || y.IsNil() {
+      return cmpBools(!x.IsNil(), !y.IsNil())
+    }
+    if x.CanInterface() && y.CanInterface() && AreEqual(x.Interface(), y.Interface()) {
+      return 0
+    }
+    if isCoDatatypeRef(x) {
+      return compareReflect(x.Elem(), y.Elem())
+    }
+    return cmpUint64s(uint64(x.Pointer()), uint64(y.Pointer()))
+  default:
+    return cmpUint64s(uint64(x.Pointer()), uint64(y.Pointer()))
+  }
+}
+
+// isCoDatatypeRef returns whether a pointer refers to a constructor of a
+// co-inductive datatype, which is compared by value like any other datatype.
+func isCoDatatypeRef(v refl.Value) bool {
+  _, ok := v.Type().MethodByName("Get")
+  return ok && v.Elem().Kind() == refl.Struct
+}
+
+// Sorted returns a new sequence with the elements of this one in the order
+// given by Compare.
+func (seq Seq) Sorted() Seq {
+  return seq.SortBy(func(v interface{}) interface{} { return v })
+}
+
+// SortBy returns a new sequence with the elements of this one ordered by the
+// given key, according to Compare.  Elements with equal keys keep their
+// relative order.
+func (seq Seq) SortBy(key func(interface{}) interface{}) Seq {
+  keys := make([]interface{}, len(seq.contents))
+  perm := make([]int, len(seq.contents))
+  for i, v := range seq.contents {
+    keys[i] = key(v)
+    perm[i] = i
+  }
+  sort.SliceStable(perm, func(i, j int) bool {
+    return Compare(keys[perm[i]], keys[perm[j]]) < 0
+  })
+  arr := make([]interface{}, len(seq.contents))
+  for i, j := range perm {
+    arr[i] = seq.contents[j]
+  }
+  return Seq{arr, seq.elemType}
+}
+
+/******************************************************************************
+ * Formatting
+ ******************************************************************************/
+
+// The runtime's values implement fmt.Formatter, supporting these verbs:
+//
+//   %v, %s  Dafny syntax, as printed by Dafny programs
+//   %q      like %v, but with strings and characters as Dafny literals
+//   %d, %x, %X, %o, %b
+//           integers (including characters' code points) in the given base
+//   %#v     Go syntax that constructs the value, such as dafny.SeqOf(...)
+//
+// Collections apply the verb to each of their elements.
+
+// writePadded writes a formatted value, honoring the width and the - flag.
+func writePadded(f fmt.State, s string) {
+  if width, ok := f.Width(); ok && len([]rune(s)) < width {
+    pad := strings.Repeat(" ", width-len([]rune(s)))
+    if f.Flag('-') {
+      s += pad
+    } else {
+      s = pad + s
+    }
+  }
+  fmt.Fprint(f, s)
+}
+
+// elementDirective reconstructs the formatting directive to be applied to the
+// elements of a collection (leaving out the width, which is for the whole).
+func elementDirective(f fmt.State, verb rune) string {
+  d := "%"
+  for _, flag := range "+-# 0" {
+    if f.Flag(int(flag)) {
+      d += string(flag)
+    }
+  }
+  return d + string(verb)
+}
+
+// formatElement formats a value nested in a collection.
+func formatElement(directive string, x interface{}) string {
+  if IsDafnyNull(x) {
+    if directive == "%#v" {
+      return "nil"
+    }
+    return "null"
+  }
+  if directive == "%v" || directive == "%s" {
+    return StringOfElement(x)
+  }
+  return fmt.Sprintf(directive, x)
+}
+
+func formatElements(directive string, values []interface{}) string {
+  strs := make([]string, len(values))
+  for i, v := range values {
+    strs[i] = formatElement(directive, v)
+  }
+  return strings.Join(strs, ", ")
+}
+
+func isGoSyntax(f fmt.State, verb rune) bool {
+  return verb == 'v' && f.Flag('#')
+}
+
+// escapeDafnyChar escapes a character for use in a Dafny character or string
+// literal with the given quote.
+func escapeDafnyChar(c rune, quote rune) string {
+  switch c {
+  case '\\':
+    return "\\\\"
+  case quote:
+    return "\\" + string(quote)
+  case 0:
+    return "\\0"
+  case '\n':
+    return "\\n"
+  case '\r':
+    return "\\r"
+  case '\t':
+    return "\\t"
+  }
+  if c < 0x20 || c == 0x7f || c > 0xffff || !strconv.IsPrint(c) {
+    if c > 0xffff {
+      return fmt.Sprintf("\\U{%x}", c)
+    }
+    return fmt.Sprintf("\\u%04x", c)
+  }
+  return string(c)
+}
+
+// QuoteChar returns a Dafny character literal for the given character.
+func QuoteChar(c Char) string {
+  return "'" + escapeDafnyChar(rune(c), '\'') + "'"
+}
+
+// QuoteString returns a Dafny string literal for the given characters.
+func QuoteString(chars []interface{}) string {
+  var sb strings.Builder
+  sb.WriteByte('"')
+  for _, c := range chars {
+    sb.WriteString(escapeDafnyChar(rune(c.(Char)), '"'))
+  }
+  sb.WriteByte('"')
+  return sb.String()
+}
+
+// Format implements fmt.Formatter.
+func (i Int) Format(f fmt.State, verb rune) {
+  if i.impl == nil {
+    // A zero-valued Int formats as zero, as in Int.hash
+    i = Zero
+  }
+  switch {
+  case isGoSyntax(f, verb):
+    if i.impl.IsInt64() {
+      writePadded(f, fmt.Sprintf("dafny.IntOfInt64(%d)", i.impl.Int64()))
+    } else {
+      writePadded(f, fmt.Sprintf("dafny.IntOfString(%q)", i.String()))
+    }
+  case verb == 'd' || verb == 'x' || verb == 'X' || verb == 'o' || verb == 'O' || verb == 'b':
+    i.impl.Format(f, verb)
+  default:
+    writePadded(f, i.String())
+  }
+}
+
+// Format implements fmt.Formatter.
+func (x Real) Format(f fmt.State, verb rune) {
+  if isGoSyntax(f, verb) {
+    writePadded(f, fmt.Sprintf("dafny.RealOfString(%q)", x.impl.RatString()))
+  } else {
+    writePadded(f, x.String())
+  }
+}
+
+// Format implements fmt.Formatter.
+func (char Char) Format(f fmt.State, verb rune) {
+  switch {
+  case isGoSyntax(f, verb):
+    writePadded(f, "dafny.Char("+strconv.QuoteRune(rune(char))+")")
+  case verb == 'q':
+    writePadded(f, QuoteChar(char))
+  case verb == 'd' || verb == 'x' || verb == 'X' || verb == 'o' || verb == 'O' || verb == 'b' || verb == 'U':
+    fmt.Fprintf(f, fmt.FormatString(f, verb), rune(char))
+  default:
+    writePadded(f, char.String())
+  }
+}
+
+// Format implements fmt.Formatter.
+func (seq Seq) Format(f fmt.State, verb rune) {
+  switch {
+  case isGoSyntax(f, verb):
+    if seq.isCharSeq() {
+      writePadded(f, "dafny.SeqOfString("+strconv.Quote(seq.ToGoString())+")")
+    } else {
+      writePadded(f, "dafny.SeqOf("+formatElements("%#v", seq.contents)+")")
+    }
+  case verb == 'v' || verb == 's':
+    writePadded(f, seq.String())
+  case verb == 'q' && seq.isCharSeq():
+    writePadded(f, QuoteString(seq.contents))
+  default:
+    writePadded(f, "["+formatElements(elementDirective(f, verb), seq.contents)+"]")
+  }
+}
+
+// Format implements fmt.Formatter.
+func (set Set) Format(f fmt.State, verb rune) {
+  switch {
+  case isGoSyntax(f, verb):
+    writePadded(f, "dafny.SetOf("+formatElements("%#v", set.elements())+")")
+  case verb == 'v' || verb == 's':
+    writePadded(f, set.String())
+  default:
+    writePadded(f, "{"+formatElements(elementDirective(f, verb), set.elements())+"}")
+  }
+}
+
+// Format implements fmt.Formatter.
+func (set SortedSet) Format(f fmt.State, verb rune) {
+  if isGoSyntax(f, verb) {
+    writePadded(f, "dafny.SortedSetOf("+formatElements("%#v", set.contents)+")")
+  } else {
+    set.Set().Format(f, verb)
+  }
+}
+
+// Format implements fmt.Formatter.
+func (mset MultiSet) Format(f fmt.State, verb rune) {
+  var values []interface{}
+  for v := range mset.All() {
+    values = append(values, v)
+  }
+  switch {
+  case isGoSyntax(f, verb):
+    writePadded(f, "dafny.MultiSetOf("+formatElements("%#v", values)+")")
+  case verb == 'v' || verb == 's':
+    writePadded(f, mset.String())
+  default:
+    writePadded(f, "multiset{"+formatElements(elementDirective(f, verb), values)+"}")
+  }
+}
+
+// Format implements fmt.Formatter.
+func (m Map) Format(f fmt.State, verb rune) {
+  switch {
+  case isGoSyntax(f, verb):
+    s := "dafny.NewMapBuilder()"
+    for _, e := range m.elts {
+      s += ".Add(" + formatElement("%#v", e.key) + ", " + formatElement("%#v", e.value) + ")"
+    }
+    writePadded(f, s+".ToMap()")
+  case verb == 'v' || verb == 's':
+    writePadded(f, m.String())
+  default:
+    d := elementDirective(f, verb)
+    strs := make([]string, len(m.elts))
+    for i, e := range m.elts {
+      strs[i] = formatElement(d, e.key) + " := " + formatElement(d, e.value)
+    }
+    writePadded(f, "map["+strings.Join(strs, ", ")+"]")
+  }
+}
+
+// Format implements fmt.Formatter.
+func (m SortedMap) Format(f fmt.State, verb rune) {
+  if isGoSyntax(f, verb) {
+    fmt.Fprintf(f, "dafny.SortedMapFrom(%#v)", m.Map())
+  } else {
+    m.Map().Format(f, verb)
+  }
+}
+
+// Format implements fmt.Formatter.
+func (tuple Tuple) Format(f fmt.State, verb rune) {
+  switch {
+  case isGoSyntax(f, verb):
+    writePadded(f, "dafny.TupleOf("+formatElements("%#v", tuple.contents)+")")
+  case verb == 'v' || verb == 's':
+    writePadded(f, tuple.String())
+  default:
+    writePadded(f, "("+formatElements(elementDirective(f, verb), tuple.contents)+")")
+  }
+}
+
+// Format implements fmt.Formatter.  Go syntax is only available for
+// one-dimensional arrays; others are formatted as with %v.
+func (array *Array) Format(f fmt.State, verb rune) {
+  switch {
+  case array == nil:
+    writePadded(f, "null")
+  case isGoSyntax(f, verb) && len(array.dims) == 1:
+    writePadded(f, "dafny.NewArrayWithValues("+formatElements("%#v", array.contents)+")")
+  case verb == 'v' || verb == 's' || len(array.dims) != 1:
+    writePadded(f, array.String())
+  default:
+    writePadded(f, "["+formatElements(elementDirective(f, verb), array.contents)+"]")
+  }
+}
+
+/******************************************************************************
+ * Run-time type descriptors (RTDs)
+ ******************************************************************************/
+
+// A TypeDescriptor has the ability to produce a default value for an associated type.
+type TypeDescriptor interface {
+  Default() interface{}
+}
+
+func CreateStandardTypeDescriptor(value interface{}) TypeDescriptor {
+  return standardTypeDescriptor{value}
+}
+
+type standardTypeDescriptor struct {
+  defaultValue interface{}
+}
+
+func (rtd standardTypeDescriptor) Default() interface{} {
+  return rtd.defaultValue
+}
+
+// IntType is the RTD for int
+var IntType = CreateStandardTypeDescriptor(Zero)
+
+// BoolType is the RTD of bool
+var BoolType = CreateStandardTypeDescriptor(false)
+
+// CharType is the RTD of char
+var CharType = CreateStandardTypeDescriptor(Char('D'))  // See CharType.DefaultValue in Dafny source code
+
+// RealType is the RTD for real
+var RealType = CreateStandardTypeDescriptor(ZeroReal)
+
+// Int8Type is the RTD of int8
+var Int8Type = CreateStandardTypeDescriptor(int8(0))
+
+// Int16Type is the RTD of int16
+var Int16Type = CreateStandardTypeDescriptor(int16(0))
+
+// Int32Type is the RTD of int32
+var Int32Type = CreateStandardTypeDescriptor(int32(0))
+
+// Int64Type is the RTD of int64.
+var Int64Type = CreateStandardTypeDescriptor(int64(0))
+
+// PossiblyNullType is the RTD of any possibly null reference type
+var PossiblyNullType = CreateStandardTypeDescriptor((*interface{})(nil))
+
+// Uint8Type is the RTD of uint8
+var Uint8Type = CreateStandardTypeDescriptor(uint8(0))
+
+// Uint16Type is the RTD of uint16
+var Uint16Type = CreateStandardTypeDescriptor(uint16(0))
+
+// Uint32Type is the RTD of uint32
+var Uint32Type = CreateStandardTypeDescriptor(uint32(0))
+
+// Uint64Type is the RTD of uint64
+var Uint64Type = CreateStandardTypeDescriptor(uint64(0))
+
+// SetType is the RTD for sets
+var SetType = CreateStandardTypeDescriptor(EmptySet)
+
+// MultiSetType is the RTD for multisets
+var MultiSetType = CreateStandardTypeDescriptor(EmptyMultiSet)
+
+// SeqType is the RTD for sequences
+var SeqType = CreateStandardTypeDescriptor(EmptySeq)
+
+// MapType is the RTD for maps
+var MapType = CreateStandardTypeDescriptor(EmptyMap)
+
+/******************************************************************************
+ * Trait parent information
+ ******************************************************************************/
+
+// Every class gets compiled to have a ParentTraits_ method, which returns the
+// list of Dafny parent traits (including transitive parent traits). This is
+// used to determine, at run time, if a given object satisfies a particular trait.
+// While it is unusual that this information is needed, it is needed in a situation
+// like
+//   var s: set<UberTrait> := ...
+//   // the following line requires run-time check that t (of type UberTrait) is a Trait
+//   var ts := set t: Trait | t in s;
+// A more straightforward situation is the expression
+//   x is Trait
+
+type TraitID struct {
+  dummy byte
+}
+
+type TraitOffspring interface {
+  ParentTraits_() []*TraitID
+}
+
+func InstanceOfTrait(obj TraitOffspring, trait *TraitID) bool {
+  for _, parent := range obj.ParentTraits_() {
+    if parent == trait {
+      return true
+    }
+  }
+  return false
+}
+
+// Use this method to test if an object "p" has a given class type (denoted by the
+// type of "q"). More generally, this method returns true if p and q are of the
+// same type. It is assumed that neither "p" nor "q" denotes a Dafny "null" value.
+
+func InstanceOf(p interface{}, q interface{}) bool {
+  return refl.TypeOf(p) == refl.TypeOf(q)
+}
+
+/******************************************************************************
+ * Object
+ ******************************************************************************/
+
+type Object struct {
+  dummy byte
+}
+
+func New_Object() *Object {
+  _this := Object{}
+  return &_this
+}
+
+func (_this *Object) Equals(other *Object) bool {
+  return _this == other
+}
+
+func (_this *Object) EqualsGeneric(x interface{}) bool {
+  other, ok := x.(*Object)
+  return ok && _this.Equals(other)
+}
+
+func (*Object) String() string {
+  return "object"
+}
+
+func (_this *Object) ParentTraits_() []*TraitID {
+  return [](*TraitID){};
+}
+var _ TraitOffspring = &Object{}
+
+/******************************************************************************
+ * Characters
+ ******************************************************************************/
+
+// A Char is a rune in a wrapper so that we can detect it and treat it
+// distinctly from int32.
+type Char rune
+
+func (char Char) String() string {
+  return fmt.Sprintf("%c", rune(char))
+}
+
+// AllChars returns an iterator that returns all 16-bit characters.
+func AllChars() Iterator {
+  c := int32(0)
+  return withBudget("AllChars", func() (interface{}, bool) {
+    CheckCanceled()
+    if c >= 0x10000 {
+      return -1, false
+    } else {
+      ans := Char(c)
+      c++
+      return ans, true
+    }
+  })
+}
+
+/******************************************************************************
+ * Slices
+ ******************************************************************************/
+
+func sliceEquals(s1, s2 []interface{}) bool {
+  return len(s1) == len(s2) && sliceIsPrefixAfterLengthCheck(s1, s2)
+}
+
+func sliceIsPrefixOf(s1, s2 []interface{}) bool {
+  return len(s1) <= len(s2) && sliceIsPrefixAfterLengthCheck(s1, s2)
+}
+
+func sliceIsProperPrefixOf(s1, s2 []interface{}) bool {
+  return len(s1) < len(s2) && sliceIsPrefixAfterLengthCheck(s1, s2)
+}
+
+func sliceIsPrefixAfterLengthCheck(s1, s2 []interface{}) bool {
+  for i, v := range s1 {
+    if !(AreEqual(v, s2[i])) {
+      return false
+    }
+  }
+  return true
+}
+
+func sliceContains(s []interface{}, value interface{}) bool {
+  for _, v := range s {
+    if AreEqual(v, value) {
+      return true
+    }
+  }
+  return false
+}
+
+// Iterator returns an iterator over the sequence.
+func sliceIterator(s []interface{}) Iterator {
+  i := 0
+  n := len(s)
+  return func() (interface{}, bool) {
+    CheckCanceled()
+    if i >= n {
+      return nil, false
+    }
+    ans := s[i]
+    i++
+    return ans, true
+  }
+}
+
+func stringOfElements(s []interface{}) string {
+  str := ""
+  for i, v := range s {
+    if i > 0 {
+      str += ", "
+    }
+    str += StringOfElement(v)
+  }
+  return str
+}
+
+// StringOfElement formats a value that occurs inside a collection, tuple or
+// datatype.  Unlike at the top level, characters and strings are printed there
+// as escaped Dafny literals ('a' and "abc"), as the other backends do.
+func StringOfElement(x interface{}) string {
+  switch x := x.(type) {
+  case Char:
+    return QuoteChar(x)
+  case Seq:
+    if x.isCharSeq() {
+      return QuoteString(x.contents)
+    }
+  }
+  return String(x)
+}
+
+/******************************************************************************
+ * Iteration
+ ******************************************************************************/
+
+// An Iterator is a function that can be called multiple times to get successive
+// values, until the second value returned is false.
+type Iterator = func() (interface{}, bool)
+
+// An Iterable can produce an iterator, which we represent as a function which
+// can be called to get successive values.
+type Iterable interface {
+  Iterator() Iterator
+}
+
+// Iterate gets an iterator from a value that is either an iterator, an
+// iterable, or a standard iter.Seq.
+func Iterate(over interface{}) Iterator {
+  if seq, ok := asIterSeq(over); ok {
+    return FromIterSeq(seq)
+  }
+  switch over := over.(type) {
+  case Iterator:
+    return over
+  case Iterable:
+    return over.Iterator()
+  default:
+    if refl.TypeOf(over).Kind() != refl.Slice {
+      panic(fmt.Errorf("Not iterable: %v", over))
+    } else {
+      return anySliceIterator(over)
+    }
+  }
+}
+
+func anySliceIterator(slice interface{}) Iterator {
+  val := refl.ValueOf(slice)
+  n := val.Len()
+  i := 0
+  return func() (interface{}, bool) {
+    CheckCanceled()
+    if i >= n {
+      return nil, false
+    } else {
+      ans := val.Index(i).Interface()
+      i++
+      return ans, true
+    }
+  }
+}
+
+// iterateStoppable is like Iterate, but also returns a function to call if the
+// iterator is abandoned before it's exhausted, which releases a standard
+// iter.Seq that is being pulled from.
+func iterateStoppable(over interface{}) (Iterator, func()) {
+  if seq, ok := asIterSeq(over); ok {
+    return PullIterSeq(seq)
+  }
+  return Iterate(over), func() {}
+}
+
+func asIterSeq(over interface{}) (iter.Seq[interface{}], bool) {
+  switch over := over.(type) {
+  case iter.Seq[interface{}]:
+    return over, true
+  case func(func(interface{}) bool):
+    return over, true
+  }
+  return nil, false
+}
+
+// All returns a standard iter.Seq over any value accepted by Iterate, so that
+// it can be used in a range-over-func loop.
+func All(over interface{}) iter.Seq[interface{}] {
+  if seq, ok := asIterSeq(over); ok {
+    return seq
+  }
+  return ToIterSeq(Iterate(over))
+}
+
+// ToIterSeq converts an Iterator into a standard iter.Seq.  The iterator is
+// consumed as the sequence is ranged over, so the result should be used only
+// once.
+func ToIterSeq(it Iterator) iter.Seq[interface{}] {
+  return func(yield func(interface{}) bool) {
+    for {
+      v, ok := it()
+      if !ok || !yield(v) {
+        return
+      }
+    }
+  }
+}
+
+// FromIterSeq converts a standard iter.Seq into an Iterator.  The underlying
+// sequence is pulled one value at a time, and released once it's exhausted or,
+// if the Iterator is abandoned early, once the Iterator has been garbage
+// collected.  Use PullIterSeq to release it as soon as it's abandoned.
+func FromIterSeq(seq iter.Seq[interface{}]) Iterator {
+  next, stop := iter.Pull(seq)
+  // The cleanup is attached to a value that only the Iterator refers to; the
+  // pulled sequence itself is kept alive by its suspended coroutine
+  pull := &struct{ next func() (interface{}, bool) }{next}
+  runtime.AddCleanup(pull, func(stop func()) { stop() }, stop)
+  return func() (interface{}, bool) {
+    return pull.next()
+  }
+}
+
+// PullIterSeq converts a standard iter.Seq into an Iterator, along with a
+// function that releases the sequence, which must be called if the Iterator is
+// abandoned before it's exhausted.  Calling it again, or after the Iterator is
+// exhausted, does nothing.
+func PullIterSeq(seq iter.Seq[interface{}]) (Iterator, func()) {
+  next, stop := iter.Pull(seq)
+  return next, stop
+}
+
+func sliceAll(s []interface{}) iter.Seq[interface{}] {
+  return func(yield func(interface{}) bool) {
+    for _, v := range s {
+      CheckCanceled()
+      if !yield(v) {
+        return
+      }
+    }
+  }
+}
+
+// An EnumerationBudget bounds how long an iterator over an unbounded (or very
+// large) domain may run, so that a compiled assign-such-that statement or
+// quantifier that the compiler couldn't bound fails instead of hanging.  The
+// budget applies to AllIntegers, AllChars, and IntegerRange when one of its
+// bounds is missing.  A zero Fuel or Timeout means no limit of that kind.
+type EnumerationBudget struct {
+  Fuel    int64         // maximum number of values yielded
+  Timeout time.Duration // maximum time since the iterator was created
+}
+
+var enumerationBudget atomic.Pointer[EnumerationBudget]
+
+// SetEnumerationBudget sets the budget given to iterators created from now on
+// and returns the previous one.
+func SetEnumerationBudget(budget EnumerationBudget) EnumerationBudget {
+  old := enumerationBudget.Swap(&budget)
+  if old == nil {
+    return EnumerationBudget{}
+  }
+  return *old
+}
+
+// GetEnumerationBudget returns the current enumeration budget.
+func GetEnumerationBudget() EnumerationBudget {
+  if budget := enumerationBudget.Load(); budget != nil {
+    return *budget
+  }
+  return EnumerationBudget{}
+}
+
+// How many values are yielded between checks of the clock
+const budgetClockInterval = 1024
+
+// withBudget wraps an iterator so that it halts once the current enumeration
+// budget runs out.  The name identifies the enumeration in the halt message.
+func withBudget(name string, it Iterator) Iterator {
+  budget := GetEnumerationBudget()
+  if budget.Fuel <= 0 && budget.Timeout <= 0 {
+    return it
+  }
+  var deadline time.Time
+  if budget.Timeout > 0 {
+    deadline = time.Now().Add(budget.Timeout)
+  }
+  n := int64(0)
+  return func() (interface{}, bool) {
+    if budget.Fuel > 0 && n >= budget.Fuel {
+      panic(fmt.Sprintf("enumeration %s ran out of fuel after %d values", name, n))
+    }
+    if budget.Timeout > 0 && n%budgetClockInterval == 0 && n > 0 && time.Now().After(deadline) {
+      panic(fmt.Sprintf("enumeration %s timed out after %v (%d values)", name, budget.Timeout, n))
+    }
+    n++
+    return it()
+  }
+}
+
+// Quantifier calculates whether a predicate holds either for all values yielded
+// by an iterator or for at least one.  Predicates of common function types are
+// evaluated without reflection; any other one-argument function returning bool
+// is called through reflection as a fallback.
+func Quantifier(iter interface{}, isForAll bool, pred interface{}) bool {
+  switch pred := pred.(type) {
+  case func(interface{}) bool:
+    return QuantifierFunc(iter, isForAll, pred)
+  case func(Int) bool:
+    return QuantifierOf(iter, isForAll, pred)
+  case func(bool) bool:
+    return QuantifierOf(iter, isForAll, pred)
+  case func(Char) bool:
+    return QuantifierOf(iter, isForAll, pred)
+  case func(Seq) bool:
+    return QuantifierOf(iter, isForAll, pred)
+  case func(Set) bool:
+    return QuantifierOf(iter, isForAll, pred)
+  case func(Tuple) bool:
+    return QuantifierOf(iter, isForAll, pred)
+  default:
+    return quantifierReflect(iter, isForAll, pred)
+  }
+}
+
+// QuantifierFunc is like Quantifier, but takes an untyped predicate, which is
+// called directly.
+func QuantifierFunc(iter interface{}, isForAll bool, pred func(interface{}) bool) bool {
+  i, stop := iterateStoppable(iter)
+  defer stop()
+  if workers, done := parallelWorkers(); workers > 1 {
+    defer done()
+    return parallelQuantifier(i, isForAll, pred, workers)
+  }
+  for {
+    CheckCanceled()
+    v, ok := i()
+    if !ok {
+      return isForAll
+    }
+    if pred(v) != isForAll {
+      return !isForAll
+    }
+  }
+}
+
+// QuantifierOf is like Quantifier, but takes a predicate over a particular
+// element type.  Each value yielded by the iterator is converted to that type
+// with a type assertion; nil values are passed as the zero value of T.
+func QuantifierOf[T any](iter interface{}, isForAll bool, pred func(T) bool) bool {
+  if r, ok := iter.(IntRange); ok && Parallelism() > 1 && !r.Lo.IsNilInt() && !r.Hi.IsNilInt() {
+    if pred, ok := any(pred).(func(Int) bool); ok {
+      return ParallelRangeQuantifier(r.Lo, r.Hi, isForAll, pred)
+    }
+  }
+  i, stop := iterateStoppable(iter)
+  defer stop()
+  if workers, done := parallelWorkers(); workers > 1 {
+    defer done()
+    return parallelQuantifier(i, isForAll, pred, workers)
+  }
+  for {
+    CheckCanceled()
+    v, ok := i()
+    if !ok {
+      return isForAll
+    }
+    if pred(valueAs[T](v)) != isForAll {
+      return !isForAll
+    }
+  }
+}
+
+// QuantifierSeq is like QuantifierOf, but ranges over a standard iter.Seq.
+func QuantifierSeq[T any](seq iter.Seq[T], isForAll bool, pred func(T) bool) bool {
+  for v := range seq {
+    CheckCanceled()
+    if pred(v) != isForAll {
+      return !isForAll
+    }
+  }
+  return isForAll
+}
+
+func valueAs[T any](v interface{}) T {
+  if v == nil {
+    var zero T
+    return zero
+  }
+  return v.(T)
+}
+
+func quantifierReflect(iter interface{}, isForAll bool, pred interface{}) bool {
+  predVal := refl.ValueOf(pred)
+
+  i, stop := iterateStoppable(iter)
+  defer stop()
+  for {
+    CheckCanceled()
+    v, ok := i()
+    if !ok {
+      return isForAll
+    }
+    if predVal.Call([]refl.Value{refl.ValueOf(v)})[0].Interface() != isForAll {
+      return !isForAll
+    }
+  }
+}
+
+// SingleValue produces an iterator that yields only a single value.
+func SingleValue(value interface{}) Iterator {
+  done := false
+  return func() (interface{}, bool) {
+    if done {
+      return nil, false
+    } else {
+      done = true
+      return value, true
+    }
+  }
+}
+
+// AllBooleans returns an iterator that returns false, then returns true.
+func AllBooleans() Iterator {
+  phase := 0
+  return func() (interface{}, bool) {
+    switch phase {
+    case 0:
+      phase = 1
+      return false, true
+    case 1:
+      phase = 2
+      return true, true
+    default:
+      return false, false
+    }
+  }
+}
+
+/******************************************************************************
+ * Choice strategies
+ ******************************************************************************/
+
+// A compiled assign-such-that statement (x :| P(x)) searches the candidate
+// values through Choices and picks the first one that satisfies P.  A
+// ChoiceStrategy decides the order in which the candidates are tried, and
+// thereby which legal witness gets picked.
+type ChoiceStrategy interface {
+  // Candidates reorders the candidate values.  The result must yield every
+  // value of the original iterator, so that a witness is always found.
+  Candidates(candidates Iterator) Iterator
+}
+
+type choiceStrategyHolder struct {
+  strategy ChoiceStrategy
+}
+
+var choiceStrategy atomic.Value // holds a choiceStrategyHolder
+
+// FirstWitness is the default strategy, which tries the candidates in the
+// order they are produced.
+var FirstWitness ChoiceStrategy = firstWitness{}
+
+type firstWitness struct{}
+
+func (firstWitness) Candidates(candidates Iterator) Iterator {
+  return candidates
+}
+
+// SetChoiceStrategy sets the strategy used by assign-such-that statements and
+// returns the previous one.
+func SetChoiceStrategy(strategy ChoiceStrategy) ChoiceStrategy {
+  if strategy == nil {
+    strategy = FirstWitness
+  }
+  old := choiceStrategy.Swap(choiceStrategyHolder{strategy})
+  if old == nil {
+    return FirstWitness
+  }
+  return old.(choiceStrategyHolder).strategy
+}
+
+// GetChoiceStrategy returns the strategy used by assign-such-that statements.
+func GetChoiceStrategy() ChoiceStrategy {
+  if h := choiceStrategy.Load(); h != nil {
+    return h.(choiceStrategyHolder).strategy
+  }
+  return FirstWitness
+}
+
+// Choices returns an iterator over the candidate values of an assign-such-that
+// statement, ordered according to the current choice strategy.
+func Choices(over interface{}) Iterator {
+  return GetChoiceStrategy().Candidates(Iterate(over))
+}
+
+// A SiteChoiceStrategy is a ChoiceStrategy that tells the assign-such-that
+// statements apart, as well as the executions of each one.  A statement with
+// several variables searches the candidates of the later ones once per
+// candidate of the earlier ones (and, if some are unbounded, in rounds), and
+// all these searches belong to the same choice.
+type SiteChoiceStrategy interface {
+  ChoiceStrategy
+  // Enter is called at the start of each execution of the assign-such-that
+  // statement with the given name, and returns a number that identifies the
+  // execution among those of the same statement.
+  Enter(name string) int
+  // CandidatesAt reorders the candidate values for the given variable (by
+  // index) of the given execution of a statement.
+  CandidatesAt(site *ChoiceSite, variable int, candidates Iterator) Iterator
 }
 
-type TraitOffspring interface {
-  ParentTraits_() []*TraitID
+// A ChoiceSite is one execution of a compiled assign-such-that statement.
+type ChoiceSite struct {
+  Name      string // the location of the statement in the source
+  Execution int    // the number given by the strategy, if it tells executions apart
+  strategy  ChoiceStrategy
 }
 
-func InstanceOfTrait(obj TraitOffspring, trait *TraitID) bool {
-  for _, parent := range obj.ParentTraits_() {
-    if parent == trait {
-      return true
-    }
+// EnterChoice is called by compiled code at the start of an assign-such-that
+// statement, whose candidates are then obtained from the ChoiceSite returned.
+func EnterChoice(name string) *ChoiceSite {
+  site := &ChoiceSite{Name: name, strategy: GetChoiceStrategy()}
+  if strategy, ok := site.strategy.(SiteChoiceStrategy); ok {
+    site.Execution = strategy.Enter(name)
   }
-  return false
+  return site
 }
 
-// Use this method to test if an object "p" has a given class type (denoted by the
-// type of "q"). More generally, this method returns true if p and q are of the
-// same type. It is assumed that neither "p" nor "q" denotes a Dafny "null" value.
-
-func InstanceOf(p interface{}, q interface{}) bool {
-  return refl.TypeOf(p) == refl.TypeOf(q)
+// Choices returns an iterator over the candidate values for the given variable
+// (by index) of the statement, ordered according to the choice strategy that
+// was current when the statement started.
+func (site *ChoiceSite) Choices(variable int, over interface{}) Iterator {
+  if strategy, ok := site.strategy.(SiteChoiceStrategy); ok {
+    return strategy.CandidatesAt(site, variable, Iterate(over))
+  }
+  return site.strategy.Candidates(Iterate(over))
 }
 
-/******************************************************************************
- * Object
- ******************************************************************************/
+// reorderWindow pulls up to n values from an iterator, yields them in the
+// order given by perm (a permutation of their indices), and then yields the
+// rest of the iterator as is.
+func reorderWindow(it Iterator, n int, perm func(n int) []int) Iterator {
+  window := make([]interface{}, 0, n)
+  for len(window) < n {
+    v, ok := it()
+    if !ok {
+      break
+    }
+    window = append(window, v)
+  }
+  order := perm(len(window))
+  i := 0
+  return func() (interface{}, bool) {
+    if i < len(order) {
+      v := window[order[i]]
+      i++
+      return v, true
+    }
+    return it()
+  }
+}
 
-type Object struct {
-  dummy byte
+type randomChoice struct {
+  mu     sync.Mutex
+  rng    *rand.Rand
+  window int
 }
 
-func New_Object() *Object {
-  _this := Object{}
-  return &_this
+// NewRandomChoice returns a strategy that shuffles the first window candidates
+// using a pseudo-random generator with the given seed, so that the same seed
+// leads to the same choices.
+func NewRandomChoice(seed int64, window int) ChoiceStrategy {
+  return &randomChoice{rng: rand.New(rand.NewSource(seed)), window: max(1, window)}
 }
 
-func (_this *Object) Equals(other *Object) bool {
-  return _this == other
+func (rc *randomChoice) Candidates(candidates Iterator) Iterator {
+  return reorderWindow(candidates, rc.window, func(n int) []int {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    return rc.rng.Perm(n)
+  })
 }
 
-func (_this *Object) EqualsGeneric(x interface{}) bool {
-  other, ok := x.(*Object)
-  return ok && _this.Equals(other)
+type choicePoint struct {
+  offset, size int
 }
 
-func (*Object) String() string {
-  return "object"
+// A choiceKey identifies a choice: the variable of an execution of a statement.
+type choiceKey struct {
+  name      string
+  execution int
+  variable  int
 }
 
-func (_this *Object) ParentTraits_() []*TraitID {
-  return [](*TraitID){};
+// An ExhaustiveChoice is a strategy for exploring every combination of
+// choices a program can make, one run at a time.  At each assign-such-that
+// statement, the first window candidates are rotated so that the search starts
+// at a different one; every witness among them is thus picked in some run
+// (possibly more than once).  A choice is made for each variable of each
+// execution of a statement, and the searches for the same choice (such as the
+// repeated searches for the later variables of a statement) all start at the
+// same rotation.  The choices of the current run are recorded, and Next moves
+// on to the next combination, depth first.
+type ExhaustiveChoice struct {
+  mu         sync.Mutex
+  window     int
+  points     map[choiceKey]*choicePoint
+  trail      []choiceKey // the choices of the current run, in order
+  picked     map[choiceKey]interface{}
+  executions map[string]int
 }
-var _ TraitOffspring = &Object{}
 
-/******************************************************************************
- * Characters
- ******************************************************************************/
+// NewExhaustiveChoice returns a new exhaustive strategy, which is positioned
+// at the first combination of choices.
+func NewExhaustiveChoice(window int) *ExhaustiveChoice {
+  return &ExhaustiveChoice{
+    window:     max(1, window),
+    points:     make(map[choiceKey]*choicePoint),
+    picked:     make(map[choiceKey]interface{}),
+    executions: make(map[string]int),
+  }
+}
 
-// A Char is a rune in a wrapper so that we can detect it and treat it
-// distinctly from int32.
-type Char rune
+// Candidates implements the ChoiceStrategy interface.  The candidates are
+// treated as those of a statement that isn't told apart from the others, and
+// each call makes a new choice.
+func (ec *ExhaustiveChoice) Candidates(candidates Iterator) Iterator {
+  return ec.CandidatesAt(&ChoiceSite{Execution: ec.Enter("")}, 0, candidates)
+}
 
-func (char Char) String() string {
-  return fmt.Sprintf("%c", rune(char))
+// Enter implements the SiteChoiceStrategy interface.
+func (ec *ExhaustiveChoice) Enter(name string) int {
+  ec.mu.Lock()
+  defer ec.mu.Unlock()
+  n := ec.executions[name]
+  ec.executions[name] = n + 1
+  return n
 }
 
-// AllChars returns an iterator that returns all 16-bit characters.
-func AllChars() Iterator {
-  c := int32(0)
+// CandidatesAt implements the SiteChoiceStrategy interface.
+func (ec *ExhaustiveChoice) CandidatesAt(site *ChoiceSite, variable int, candidates Iterator) Iterator {
+  key := choiceKey{site.Name, site.Execution, variable}
+  reordered := reorderWindow(candidates, ec.window, func(n int) []int {
+    ec.mu.Lock()
+    defer ec.mu.Unlock()
+    point, ok := ec.points[key]
+    if !ok {
+      point = &choicePoint{0, n}
+      ec.points[key] = point
+    }
+    if _, ok := ec.picked[key]; !ok {
+      ec.trail = append(ec.trail, key)
+      ec.picked[key] = nil
+    }
+    // The later variables may have different candidates in each search
+    point.size = max(point.size, n)
+    order := make([]int, n)
+    for i := range order {
+      order[i] = (point.offset + i) % max(n, 1)
+    }
+    return order
+  })
+  // The search stops at the witness, so the last value yielded is the pick
   return func() (interface{}, bool) {
-    if c >= 0x10000 {
-      return -1, false
-    } else {
-      ans := Char(c)
-      c++
-      return ans, true
+    v, ok := reordered()
+    if ok {
+      ec.mu.Lock()
+      ec.picked[key] = v
+      ec.mu.Unlock()
     }
+    return v, ok
+  }
+}
+
+// Recorded returns the value picked at each choice made during the current
+// run.
+func (ec *ExhaustiveChoice) Recorded() []interface{} {
+  ec.mu.Lock()
+  defer ec.mu.Unlock()
+  values := make([]interface{}, len(ec.trail))
+  for i, key := range ec.trail {
+    values[i] = ec.picked[key]
+  }
+  return values
+}
+
+// Trail returns, for each choice made during the current run, the index of the
+// candidate the search started at.
+func (ec *ExhaustiveChoice) Trail() []int {
+  ec.mu.Lock()
+  defer ec.mu.Unlock()
+  offsets := make([]int, len(ec.trail))
+  for i, key := range ec.trail {
+    offsets[i] = ec.points[key].offset
+  }
+  return offsets
+}
+
+// Next moves on to the next combination of choices, to be used by the next
+// run, and returns false once every combination has been explored.
+func (ec *ExhaustiveChoice) Next() bool {
+  ec.mu.Lock()
+  defer ec.mu.Unlock()
+  trail := ec.trail
+  ec.trail = nil
+  ec.picked = make(map[choiceKey]interface{})
+  ec.executions = make(map[string]int)
+  for len(trail) > 0 {
+    last := ec.points[trail[len(trail)-1]]
+    if last.offset+1 < last.size {
+      last.offset++
+      break
+    }
+    trail = trail[:len(trail)-1]
+  }
+  // Choices that weren't reached in this run, or that are done, start over
+  points := make(map[choiceKey]*choicePoint, len(trail))
+  for _, key := range trail {
+    points[key] = ec.points[key]
   }
+  ec.points = points
+  return len(trail) > 0
 }
 
 /******************************************************************************
- * Slices
+ * Parallel evaluation
  ******************************************************************************/
 
-func sliceEquals(s1, s2 []interface{}) bool {
-  return len(s1) == len(s2) && sliceIsPrefixAfterLengthCheck(s1, s2)
-}
+// Parallel evaluation is off by default.  When it is turned on with
+// SetParallelism, quantifiers and comprehensions split the values they range
+// over into chunks that are evaluated by a pool of worker goroutines.  The
+// outcome is always the one that sequential evaluation would have produced: a
+// counterexample (or a halt) is only reported once every value before it has
+// been checked.
+//
+// Only one evaluation runs in parallel at a time.  Quantifiers and
+// comprehensions nested in it (or started by other goroutines meanwhile) are
+// evaluated sequentially, so that the number of workers stays bounded.
+//
+// Predicates and comprehension bodies must be safe to call concurrently, and
+// compiled Dafny code isn't always: a compiled expression may call an extern,
+// call a function by method whose body updates objects it shares with other
+// calls, or pick a value with :| under a ChoiceStrategy (such as an
+// ExhaustiveChoice) whose picks depend on the order of the calls.  That's why
+// parallel evaluation is opt-in; only turn it on for programs that are known
+// to be free of such effects.
+
+var parallelism int32 = 1
+var parallelChunkSize int32 = 1024
+var parallelBusy atomic.Bool
+
+// Parallelism returns the number of worker goroutines used for parallel
+// evaluation, or 1 if parallel evaluation is off.
+func Parallelism() int {
+  return int(atomic.LoadInt32(&parallelism))
+}
+
+// SetParallelism sets the number of worker goroutines used for parallel
+// evaluation and returns the previous setting.  A value of 1 or less turns
+// parallel evaluation off.
+func SetParallelism(workers int) int {
+  if workers < 1 {
+    workers = 1
+  }
+  return int(atomic.SwapInt32(&parallelism, int32(workers)))
+}
+
+// SetParallelChunkSize sets the number of values handed to a worker at a time
+// and returns the previous setting.
+func SetParallelChunkSize(n int) int {
+  if n < 1 {
+    n = 1
+  }
+  return int(atomic.SwapInt32(&parallelChunkSize, int32(n)))
+}
+
+// parallelWorkers returns the number of workers a quantifier or comprehension
+// gets, along with a function to call once it is done.  A result of 1 means
+// that it is to be evaluated sequentially.
+func parallelWorkers() (int, func()) {
+  workers := Parallelism()
+  if workers <= 1 || !parallelBusy.CompareAndSwap(false, true) {
+    return 1, func() {}
+  }
+  return workers, func() { parallelBusy.Store(false) }
+}
+
+// runParallel runs the tasks produced by next on a pool of workers.  A task
+// returns true if it is decisive, meaning that the tasks produced after it
+// don't need to run.  runParallel returns the index of the first decisive task,
+// or -1 if there is none.  If a task (or next itself) panics before any earlier
+// task was decisive, the panic is re-raised once the earlier tasks are done.
+func runParallel(workers int, next func() (func() bool, bool)) int {
+  type task struct {
+    index int
+    run   func() bool
+  }
+
+  var mu sync.Mutex
+  cutoff := math.MaxInt
+  var panicVal interface{}
+  panicked := false
+  var stop atomic.Bool
+
+  settle := func(index int, isPanic bool, val interface{}) {
+    mu.Lock()
+    if index < cutoff {
+      cutoff, panicked, panicVal = index, isPanic, val
+    }
+    mu.Unlock()
+    stop.Store(true)
+  }
+  skip := func(index int) bool {
+    mu.Lock()
+    defer mu.Unlock()
+    return index > cutoff
+  }
+  runTask := func(t task) {
+    defer func() {
+      if r := recover(); r != nil {
+        settle(t.index, true, r)
+      }
+    }()
+    if t.run() {
+      settle(t.index, false, nil)
+    }
+  }
 
-func sliceIsPrefixOf(s1, s2 []interface{}) bool {
-  return len(s1) <= len(s2) && sliceIsPrefixAfterLengthCheck(s1, s2)
-}
+  tasks := make(chan task, workers)
+  var wg sync.WaitGroup
+  for w := 0; w < workers; w++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for t := range tasks {
+        if !skip(t.index) {
+          runTask(t)
+        }
+      }
+    }()
+  }
 
-func sliceIsProperPrefixOf(s1, s2 []interface{}) bool {
-  return len(s1) < len(s2) && sliceIsPrefixAfterLengthCheck(s1, s2)
+  func() {
+    i := 0
+    defer func() {
+      if r := recover(); r != nil {
+        settle(i, true, r)
+      }
+      close(tasks)
+    }()
+    for ; !stop.Load(); i++ {
+      run, ok := next()
+      if !ok {
+        return
+      }
+      tasks <- task{i, run}
+    }
+  }()
+  wg.Wait()
+
+  if panicked {
+    panic(panicVal)
+  }
+  if cutoff == math.MaxInt {
+    return -1
+  }
+  return cutoff
 }
 
-func sliceIsPrefixAfterLengthCheck(s1, s2 []interface{}) bool {
-  for i, v := range s1 {
-    if !(AreEqual(v, s2[i])) {
-      return false
+// nextChunk pulls up to the chunk size of values from an iterator.
+func nextChunk(it Iterator) []interface{} {
+  n := int(atomic.LoadInt32(&parallelChunkSize))
+  values := make([]interface{}, 0, n)
+  for len(values) < n {
+    v, ok := it()
+    if !ok {
+      break
     }
+    values = append(values, v)
   }
-  return true
+  return values
 }
 
-func sliceContains(s []interface{}, value interface{}) bool {
-  for _, v := range s {
-    if AreEqual(v, value) {
-      return true
+func parallelQuantifier[T any](it Iterator, isForAll bool, pred func(T) bool, workers int) bool {
+  check := func(values []interface{}) bool {
+    for _, v := range values {
+      if pred(valueAs[T](v)) != isForAll {
+        return true
+      }
     }
+    return false
   }
-  return false
-}
 
-// Iterator returns an iterator over the sequence.
-func sliceIterator(s []interface{}) Iterator {
-  i := 0
-  n := len(s)
-  return func() (interface{}, bool) {
-    if i >= n {
-      return nil, false
+  first := nextChunk(it)
+  if len(first) < cap(first) {
+    // The iterator is already exhausted, so there's nothing to share out
+    if check(first) {
+      return !isForAll
     }
-    ans := s[i]
-    i++
-    return ans, true
+    return isForAll
   }
-}
 
-func stringOfElements(s []interface{}) string {
-  str := ""
-  for i, v := range s {
-    if i > 0 {
-      str += ", "
+  pending := first
+  next := func() (func() bool, bool) {
+    values := pending
+    pending = nil
+    if values == nil {
+      values = nextChunk(it)
+    }
+    if len(values) == 0 {
+      return nil, false
     }
-    str += String(v)
+    return func() bool { return check(values) }, true
   }
-  return str
+  if runParallel(workers, next) >= 0 {
+    return !isForAll
+  }
+  return isForAll
 }
 
-/******************************************************************************
- * Iteration
- ******************************************************************************/
-
-// An Iterator is a function that can be called multiple times to get successive
-// values, until the second value returned is false.
-type Iterator = func() (interface{}, bool)
-
-// An Iterable can produce an iterator, which we represent as a function which
-// can be called to get successive values.
-type Iterable interface {
-  Iterator() Iterator
-}
+// ParallelRangeQuantifier is like QuantifierOf over IntegerRange(lo, hi), but
+// when parallel evaluation is on and both bounds are given, the range is
+// sharded arithmetically so that the workers generate their own values.
+func ParallelRangeQuantifier(lo, hi Int, isForAll bool, pred func(Int) bool) bool {
+  if lo.IsNilInt() || hi.IsNilInt() {
+    return QuantifierOf(IntegerRange(lo, hi), isForAll, pred)
+  }
+  workers, done := parallelWorkers()
+  defer done()
+  if workers <= 1 {
+    return QuantifierOf(IntegerRange(lo, hi), isForAll, pred)
+  }
 
-// Iterate gets an iterator from a value that is either an iterator or an
-// iterable.
-func Iterate(over interface{}) Iterator {
-  switch over := over.(type) {
-  case Iterator:
-    return over
-  case Iterable:
-    return over.Iterator()
-  default:
-    if refl.TypeOf(over).Kind() != refl.Slice {
-      panic(fmt.Errorf("Not iterable: %v", over))
-    } else {
-      return anySliceIterator(over)
+  size := IntOf(int(atomic.LoadInt32(&parallelChunkSize)))
+  start := lo
+  next := func() (func() bool, bool) {
+    if start.Cmp(hi) >= 0 {
+      return nil, false
+    }
+    from, to := start, start.Plus(size).Min(hi)
+    start = to
+    return func() bool {
+      for i := from; i.Cmp(to) < 0; i = i.Plus(One) {
+        if pred(i) != isForAll {
+          return true
+        }
+      }
+      return false
+    }, true
+  }
+  if runParallel(workers, next) >= 0 {
+    return !isForAll
+  }
+  return isForAll
+}
+
+// ParallelBuild calls body on each value yielded by the given iterator (or
+// iterable), letting it add elements to a Builder, as a set or multiset
+// comprehension does.  When parallel evaluation is on, the values are split
+// among the workers, each chunk filling a Builder of its own; the chunks are
+// then joined in iteration order, so the result is the same as sequentially.
+func ParallelBuild[T any](iter interface{}, body func(T, *Builder)) *Builder {
+  it, stop := iterateStoppable(iter)
+  defer stop()
+  workers, done := parallelWorkers()
+  defer done()
+  if workers <= 1 {
+    b := NewBuilder()
+    for v, ok := it(); ok; v, ok = it() {
+      body(valueAs[T](v), b)
     }
+    return b
   }
-}
 
-func anySliceIterator(slice interface{}) Iterator {
-  val := refl.ValueOf(slice)
-  n := val.Len()
-  i := 0
-  return func() (interface{}, bool) {
-    if i >= n {
+  var parts []*Builder
+  next := func() (func() bool, bool) {
+    values := nextChunk(it)
+    if len(values) == 0 {
       return nil, false
-    } else {
-      ans := val.Index(i).Interface()
-      i++
-      return ans, true
     }
+    b := NewBuilder()
+    parts = append(parts, b)
+    return func() bool {
+      for _, v := range values {
+        body(valueAs[T](v), b)
+      }
+      return false
+    }, true
   }
+  runParallel(workers, next)
+
+  ans := NewBuilder()
+  for _, b := range parts {
+    *ans = append(*ans, *b...)
+  }
+  return ans
 }
 
-// Quantifier calculates whether a predicate holds either for all values yielded
-// by an iterator or for at least one.
-func Quantifier(iter interface{}, isForAll bool, pred interface{}) bool {
-  predVal := refl.ValueOf(pred)
+// ParallelMapBuild is like ParallelBuild, but accumulates into a strict
+// MapBuilder, as a map comprehension does.
+func ParallelMapBuild[T any](iter interface{}, body func(T, *MapBuilder)) *MapBuilder {
+  it, stop := iterateStoppable(iter)
+  defer stop()
+  workers, done := parallelWorkers()
+  defer done()
+  if workers <= 1 {
+    mb := NewStrictMapBuilder()
+    for v, ok := it(); ok; v, ok = it() {
+      body(valueAs[T](v), mb)
+    }
+    return mb
+  }
 
-  for i := Iterate(iter); ; {
-    v, ok := i()
-    if !ok {
-      return isForAll
+  var parts []*MapBuilder
+  next := func() (func() bool, bool) {
+    values := nextChunk(it)
+    if len(values) == 0 {
+      return nil, false
     }
-    if predVal.Call([]refl.Value{refl.ValueOf(v)})[0].Interface() != isForAll {
-      return !isForAll
+    mb := NewStrictMapBuilder()
+    parts = append(parts, mb)
+    return func() bool {
+      for _, v := range values {
+        body(valueAs[T](v), mb)
+      }
+      return false
+    }, true
+  }
+  runParallel(workers, next)
+
+  if len(parts) == 0 {
+    return NewStrictMapBuilder()
+  }
+  ans := parts[0]
+  for _, mb := range parts[1:] {
+    for _, e := range mb.elts {
+      ans.Add(e.key, e.value)
     }
   }
+  return ans
 }
 
-// SingleValue produces an iterator that yields only a single value.
-func SingleValue(value interface{}) Iterator {
-  done := false
-  return func() (interface{}, bool) {
-    if done {
-      return nil, false
-    } else {
-      done = true
-      return value, true
+/******************************************************************************
+ * Coroutines
+ ******************************************************************************/
+
+// A Coroutine runs the body of a compiled Dafny iterator.  The body runs in
+// its own goroutine, but only ever in turn with the caller of Resume, which
+// runs the body until its next yield.  The goroutine starts on the first call
+// to Resume and ends when the body returns or the coroutine is closed.
+//
+// A panic in the body (such as a halt) is raised again by Resume.  A
+// coroutine isn't safe for concurrent use.
+//
+// A coroutine that has been started must be run to completion or closed.
+// While its body is suspended, the goroutine keeps the body, and whatever the
+// body refers to, reachable, so neither a finalizer nor the garbage collector
+// can reclaim it.
+type Coroutine struct {
+  body     func(yield func() bool)
+  resume   chan bool     // true to go on, false to stop
+  yielded  chan struct{} // signaled when the body yields
+  finished chan struct{} // closed when the body returns
+  started  bool
+  done     atomic.Bool
+  panicked bool
+  panicVal interface{}
+}
+
+// The number of coroutines whose goroutines are running
+var liveCoroutines atomic.Int64
+
+var trackingCoroutines atomic.Bool
+var trackedCoroutines sync.Map // *Coroutine -> stack trace of its creation
+
+// NewCoroutine creates a coroutine with the given body.  The body is passed a
+// function that yields to the caller of Resume; it returns false if the
+// coroutine was closed in the meantime, in which case the body should return
+// right away.
+func NewCoroutine(body func(yield func() bool)) *Coroutine {
+  return &Coroutine{
+    body:     body,
+    resume:   make(chan bool),
+    yielded:  make(chan struct{}),
+    finished: make(chan struct{}),
+  }
+}
+
+// Resume runs the body until it yields, returning true, or returns, returning
+// false.  After the body has returned or the coroutine has been closed, Resume
+// just returns false.
+func (co *Coroutine) Resume() bool {
+  if co.done.Load() {
+    return false
+  }
+  if !co.started {
+    co.start()
+  }
+  co.resume <- true
+  select {
+  case <-co.yielded:
+    return true
+  case <-co.finished:
+    co.done.Store(true)
+    if co.panicked {
+      panic(co.panicVal)
     }
+    return false
   }
 }
 
-// AllBooleans returns an iterator that returns false, then returns true.
-func AllBooleans() Iterator {
-  phase := 0
-  return func() (interface{}, bool) {
-    switch phase {
-    case 0:
-      phase = 1
-      return false, true
-    case 1:
-      phase = 2
-      return true, true
-    default:
-      return false, false
+func (co *Coroutine) start() {
+  co.started = true
+  liveCoroutines.Add(1)
+  if trackingCoroutines.Load() {
+    buf := make([]byte, 4096)
+    trackedCoroutines.Store(co, string(buf[:runtime.Stack(buf, false)]))
+  }
+  go func() {
+    defer func() {
+      if r := recover(); r != nil {
+        co.panicked, co.panicVal = true, r
+      }
+      liveCoroutines.Add(-1)
+      trackedCoroutines.Delete(co)
+      close(co.finished)
+    }()
+    if <-co.resume {
+      co.body(co.yield)
     }
+  }()
+}
+
+func (co *Coroutine) yield() bool {
+  co.yielded <- struct{}{}
+  return <-co.resume
+}
+
+// Close stops the coroutine, waiting for its goroutine to end if it was
+// started.  Closing a coroutine more than once has no effect.
+func (co *Coroutine) Close() {
+  if co.done.Swap(true) || !co.started {
+    return
   }
+  // The body is waiting to start or suspended in a yield
+  co.resume <- false
+  <-co.finished
+}
+
+// LiveCoroutines returns the number of coroutines that have been started but
+// have neither finished nor been closed.  Each holds on to a goroutine, so a
+// number that keeps growing points to iterators that aren't run to completion
+// or closed.
+func LiveCoroutines() int64 {
+  return liveCoroutines.Load()
+}
+
+// TrackCoroutines turns on (or off) recording where coroutines are started,
+// for LiveCoroutineStacks to report.  It's meant for debugging, since the
+// recording is expensive.
+func TrackCoroutines(enabled bool) {
+  trackingCoroutines.Store(enabled)
+}
+
+// LiveCoroutineStacks returns the stack traces of where the live coroutines
+// were started, for those started while TrackCoroutines was on.
+func LiveCoroutineStacks() []string {
+  var stacks []string
+  trackedCoroutines.Range(func(_, stack interface{}) bool {
+    stacks = append(stacks, stack.(string))
+    return true
+  })
+  return stacks
 }
 
 /******************************************************************************
@@ -413,9 +2563,12 @@ func AllBooleans() Iterator {
 // methods for updating; instead, you can update by mutating the value returned
 // by Index (either by using its Set method or by getting a pointer using its
 // Addr method).
+//
+// A Seq may record the RTD of its elements, which is nil if it isn't known.
+// A sequence whose elements are characters is a string, and prints as one.
 type Seq struct {
   contents []interface{}
-  isString bool
+  elemType TypeDescriptor
 }
 
 // EmptySeq is the empty sequence.
@@ -428,7 +2581,7 @@ func SeqCreate(n Int, init func (Int) interface{}) Seq {
   for i := 0; i < len; i++ {
     arr[i] = init(IntOf(i))
   }
-  return Seq{arr, false}
+  return Seq{arr, nil}
 }
 
 // SeqOf returns a sequence containing the given values.
@@ -437,7 +2590,8 @@ func SeqOf(values ...interface{}) Seq {
   // if someone says SeqOf(slice...) and then mutates slice.
   arr := make([]interface{}, len(values))
   copy(arr, values)
-  return Seq{arr, false}
+  runtimeStats.seqSizes.record(len(arr))
+  return Seq{arr, nil}
 }
 
 // SeqOfChars returns a sequence containing the given character values.
@@ -446,21 +2600,80 @@ func SeqOfChars(values ...Char) Seq {
   for i, v := range values {
     arr[i] = v
   }
-  return Seq{arr, true}
+  runtimeStats.seqSizes.record(len(arr))
+  return Seq{arr, CharType}
+}
+
+// SeqOfString converts the given string into a sequence of characters.
+func SeqOfString(str string) Seq {
+  // Need to make sure the elements of the array are Chars, one per rune
+  runes := []rune(str)
+  arr := make([]interface{}, len(runes))
+  for i, v := range runes {
+    arr[i] = Char(v)
+  }
+  runtimeStats.seqSizes.record(len(arr))
+  return Seq{arr, CharType}
+}
+
+// ToGoString converts a sequence of characters to a Go string.
+func (seq Seq) ToGoString() string {
+  var sb strings.Builder
+  for _, c := range seq.contents {
+    sb.WriteRune(rune(c.(Char)))
+  }
+  return sb.String()
+}
+
+// SeqOfBytes converts the given bytes into a sequence of uint8 values.
+func SeqOfBytes(bytes []byte) Seq {
+  arr := make([]interface{}, len(bytes))
+  for i, b := range bytes {
+    arr[i] = b
+  }
+  runtimeStats.seqSizes.record(len(arr))
+  return Seq{arr, Uint8Type}
+}
+
+// ToByteArray converts a sequence of uint8 values to a byte slice.
+func (seq Seq) ToByteArray() []byte {
+  bytes := make([]byte, len(seq.contents))
+  for i, b := range seq.contents {
+    bytes[i] = b.(uint8)
+  }
+  return bytes
+}
+
+// SetString returns the sequence marked as being a string.
+func (seq Seq) SetString() Seq {
+  return seq.WithElementType(CharType)
+}
+
+// WithElementType returns the sequence with its elements' RTD set to the given
+// one.
+func (seq Seq) WithElementType(elemType TypeDescriptor) Seq {
+  return Seq{seq.contents, elemType}
+}
+
+// ElementType returns the RTD of the sequence's elements, or nil if it isn't
+// known.
+func (seq Seq) ElementType() TypeDescriptor {
+  return seq.elemType
 }
 
-// SeqOfString converts the given string into a sequence of characters.
-func SeqOfString(str string) Seq {
-  // Need to make sure the elements of the array are Chars
-  arr := make([]interface{}, len(str))
-  for i, v := range str {
-    arr[i] = Char(v)
-  }
-  return Seq{arr, true}
+// isString returns whether the sequence is known to be a string.
+func (seq Seq) isString() bool {
+  return isCharType(seq.elemType)
 }
 
-func (seq Seq) SetString() Seq {
-        return Seq{seq.contents, true}
+// isCharType returns whether the given RTD is that of char.
+func isCharType(rtd TypeDescriptor) bool {
+  std, ok := rtd.(standardTypeDescriptor)
+  if !ok {
+    return false
+  }
+  _, ok = std.defaultValue.(Char)
+  return ok
 }
 
 // Index finds the sequence element at the given index.
@@ -484,7 +2697,7 @@ func (seq Seq) UpdateInt(i int, v interface{}) Seq {
   copy(arr, seq.contents[:i])
   arr[i] = v
   copy(arr[i+1:], seq.contents[i+1:])
-  return Seq{arr, seq.isString}
+  return Seq{arr, seq.elemType}
 }
 
 // Len finds the length of the sequence.
@@ -517,6 +2730,11 @@ func (seq Seq) Iterator() Iterator {
   return sliceIterator(seq.contents)
 }
 
+// All returns an iter.Seq over the elements of the sequence.
+func (seq Seq) All() iter.Seq[interface{}] {
+  return sliceAll(seq.contents)
+}
+
 // Subseq gets the selected portion of the sequence as a new sequence.
 func (seq Seq) Subseq(lo, hi Int) Seq {
   var slice []interface{}
@@ -534,23 +2752,30 @@ func (seq Seq) Subseq(lo, hi Int) Seq {
     }
   }
 
-  return Seq{slice, seq.isString}
+  return Seq{slice, seq.elemType}
 }
 
 // Concat returns the concatenation of two sequences.
 func (seq Seq) Concat(seq2 Seq) Seq {
+  elemType := seq.elemType
+  if elemType == nil {
+    elemType = seq2.elemType
+  }
   if seq.LenInt() == 0 {
-    return seq2
+    return Seq{seq2.contents, elemType}
   }
   if seq2.LenInt() == 0 {
-    return seq
+    return Seq{seq.contents, elemType}
   }
 
   n, n2 := len(seq.contents), len(seq2.contents)
   newSlice := make([]interface{}, n+n2)
   copy(newSlice, seq.contents)
   copy(newSlice[len(seq.contents):], seq2.contents)
-  return Seq{newSlice, seq.isString || seq2.isString}
+  runtimeStats.seqConcats.add(1)
+  runtimeStats.seqConcatElements.add(uint64(n + n2))
+  runtimeStats.seqSizes.record(n + n2)
+  return Seq{newSlice, elemType}
 }
 
 // Equals compares two sequences for equality.
@@ -585,8 +2810,26 @@ func (seq Seq) UniqueElements() Set {
   return (*Builder)(&seq.contents).ToSet()
 }
 
+// isCharSeq returns whether the sequence is to be printed as a string, which
+// is when it's known to be one or when it's a nonempty sequence of characters
+// whose element type isn't known.
+func (seq Seq) isCharSeq() bool {
+  if seq.isString() {
+    return true
+  }
+  if len(seq.contents) == 0 {
+    return false
+  }
+  for _, c := range seq.contents {
+    if _, ok := c.(Char); !ok {
+      return false
+    }
+  }
+  return true
+}
+
 func (seq Seq) String() string {
-  if seq.isString {
+  if seq.isCharSeq() {
     s := ""
     for _, c := range seq.contents {
       s += c.(Char).String()
@@ -607,6 +2850,7 @@ func (seq Seq) String() string {
 type Array struct {
   contents []interface{} // stored as a flat one-dimensional slice
   dims     []int
+  elemType TypeDescriptor // passed on to sequences taken from the array
 }
 
 func newArray(dims ...Int) *Array {
@@ -636,6 +2880,9 @@ func NewArray(dims ...Int) *Array {
 // NewArrayWithValue returns a new Array full of the given initial value.
 func NewArrayWithValue(init interface{}, dims ...Int) *Array {
   ans := newArray(dims...)
+  if _, ok := init.(Char); ok {
+    ans.elemType = CharType
+  }
   if init != nil {
     for i := range ans.contents {
       ans.contents[i] = init
@@ -724,21 +2971,25 @@ func (array *Array) Iterator() Iterator {
   return sliceIterator(array.contents)
 }
 
+// All returns an iter.Seq over the elements of the array, in the same order
+// as Iterator.
+func (array *Array) All() iter.Seq[interface{}] {
+  return sliceAll(array.contents)
+}
+
+// SetString marks the array as being an array of characters, so that
+// sequences taken from it are strings.  Returns the array.
+func (array *Array) SetString() *Array {
+  array.elemType = CharType
+  return array
+}
+
 // RangeToSeq converts the selected portion of the array to a sequence.
 func (array *Array) RangeToSeq(lo, hi Int) Seq {
   if len(array.dims) != 1 {
     panic("Can't take a slice of a multidimensional array")
   }
-        isString := false;
-        if len(array.contents) > 0 {
-            _, isString = array.contents[0].(Char)
-        }
-
-  // TODO Should set isString to true if this is an array of characters
-  // Do not know if it is an array of characters if the array is empty
-  seq := SeqOf(array.contents...)
-        seq.isString = isString
-
+  seq := SeqOf(array.contents...).WithElementType(array.elemType)
   return seq.Subseq(lo, hi)
 }
 
@@ -761,7 +3012,7 @@ func (array *Array) UpdateInt(ix int, value interface{}) {
 
 func (array *Array) stringOfSubspace(d int, ixs []int) string {
   if d == len(array.dims) {
-    return String(*array.IndexInts(ixs...))
+    return StringOfElement(*array.IndexInts(ixs...))
   }
   s := "["
   for i := 0; i < array.dims[d]; i++ {
@@ -856,7 +3107,7 @@ func (tt tupleType) String() string {
  ******************************************************************************/
 
 // A Builder holds values as they're imperatively accumulated in order to build
-// an Array, Set, or MultiSet.
+// an Array, Set, Seq, or MultiSet.
 type Builder []interface{}
 
 // NewBuilder creates a new Builder.
@@ -879,18 +3130,209 @@ func (builder *Builder) ToSet() Set {
   return SetOf(*builder...)
 }
 
+// ToSeq creates a Seq with the accumulated values.
+func (builder *Builder) ToSeq() Seq {
+  return SeqOf(*builder...)
+}
+
+// ToMultiSet creates a MultiSet with the accumulated values.
+func (builder *Builder) ToMultiSet() MultiSet {
+  return MultiSetOf(*builder...)
+}
+
 // Iterator iterates over the accumulated values.
 func (builder *Builder) Iterator() Iterator {
   return sliceIterator(*builder)
 }
 
+// Reserve makes room for at least n more values.
+func (builder *Builder) Reserve(n int) {
+  *builder = reserve(*builder, n)
+}
+
+// Reset discards the accumulated values.
+func (builder *Builder) Reset() {
+  *builder = nil
+}
+
+// reserve grows the capacity of a slice to fit at least n more values.
+func reserve[T any](s []T, n int) []T {
+  if n <= cap(s)-len(s) {
+    return s
+  }
+  grown := make([]T, len(s), len(s)+n)
+  copy(grown, s)
+  return grown
+}
+
+// A SeqBuilder builds a Seq by accumulating its elements in order.
+type SeqBuilder struct {
+  contents []interface{}
+  elemType TypeDescriptor
+}
+
+// NewSeqBuilder creates a new SeqBuilder.
+func NewSeqBuilder() *SeqBuilder {
+  return &SeqBuilder{}
+}
+
+// NewStringBuilder creates a new SeqBuilder for a sequence of characters,
+// which will print as a string even if it ends up empty.
+func NewStringBuilder() *SeqBuilder {
+  return &SeqBuilder{elemType: CharType}
+}
+
+// Add appends a value to the sequence being built.
+func (sb *SeqBuilder) Add(value interface{}) *SeqBuilder {
+  sb.contents = append(sb.contents, value)
+  return sb
+}
+
+// AddAll appends the elements of a sequence to the sequence being built.
+func (sb *SeqBuilder) AddAll(seq Seq) *SeqBuilder {
+  sb.contents = append(sb.contents, seq.contents...)
+  if sb.elemType == nil {
+    sb.elemType = seq.elemType
+  }
+  return sb
+}
+
+// Len returns the number of values accumulated so far.
+func (sb *SeqBuilder) Len() int {
+  return len(sb.contents)
+}
+
+// Reserve makes room for at least n more values.
+func (sb *SeqBuilder) Reserve(n int) {
+  sb.contents = reserve(sb.contents, n)
+}
+
+// Reset discards the accumulated values.
+func (sb *SeqBuilder) Reset() {
+  sb.contents = nil
+}
+
+// ToSeq creates a Seq with the accumulated values.  The builder can go on
+// being used afterward without affecting the Seq.
+func (sb *SeqBuilder) ToSeq() Seq {
+  // Clip the capacity so that later additions don't share storage with the Seq
+  sb.contents = sb.contents[:len(sb.contents):len(sb.contents)]
+  runtimeStats.seqSizes.record(len(sb.contents))
+  return Seq{sb.contents, sb.elemType}
+}
+
+// A MultiSetBuilder builds a MultiSet by accumulating elements with their
+// multiplicities.
+type MultiSetBuilder struct {
+  mset   MultiSet
+  shared bool // whether mset is also held by a MultiSet returned from ToMultiSet
+}
+
+// NewMultiSetBuilder creates a new MultiSetBuilder.
+func NewMultiSetBuilder() *MultiSetBuilder {
+  return &MultiSetBuilder{mset: newMultiSet(0)}
+}
+
+func (mb *MultiSetBuilder) unshare() {
+  if mb.shared {
+    mset := newMultiSet(len(mb.mset.elts))
+    for _, e := range mb.mset.elts {
+      mset.appendElt(e)
+    }
+    mb.mset = mset
+    mb.shared = false
+  }
+}
+
+// Add adds one occurrence of a value to the multiset being built.
+func (mb *MultiSetBuilder) Add(value interface{}) *MultiSetBuilder {
+  mb.unshare()
+  mb.mset.add(value, msetOne)
+  return mb
+}
+
+// AddCount adds n occurrences of a value to the multiset being built.
+func (mb *MultiSetBuilder) AddCount(value interface{}, n Int) *MultiSetBuilder {
+  if n.Sign() < 0 {
+    panic("negative multiplicity: " + n.String())
+  }
+  if n.Sign() > 0 {
+    mb.unshare()
+    mb.mset.add(value, msetCountOf(n))
+  }
+  return mb
+}
+
+// Reserve makes room for at least n more distinct values.
+func (mb *MultiSetBuilder) Reserve(n int) {
+  if len(mb.mset.elts) == 0 {
+    mb.mset = newMultiSet(n)
+    mb.shared = false
+  } else {
+    mb.unshare()
+    mb.mset.elts = reserve(mb.mset.elts, n)
+  }
+}
+
+// Reset discards the accumulated values.
+func (mb *MultiSetBuilder) Reset() {
+  mb.mset = newMultiSet(0)
+  mb.shared = false
+}
+
+// ToMultiSet creates a MultiSet with the accumulated values.  The builder can
+// go on being used afterward without affecting the MultiSet.
+func (mb *MultiSetBuilder) ToMultiSet() MultiSet {
+  mb.shared = true
+  runtimeStats.multiSetSizes.record(len(mb.mset.elts))
+  return mb.mset
+}
+
 /******************************************************************************
  * Sets
  ******************************************************************************/
 
-// A Set is a sequence without duplicates.
+// A Set is a sequence without duplicates.  A Set can also be a lazy view of
+// some other collection (such as the keys of a map), whose elements are only
+// computed once an operation needs them.
 type Set struct {
   contents []interface{}
+  view     *setView
+}
+
+// A setView computes the elements of a lazy Set on demand.  Besides
+// materialize, which must produce the elements without duplicates, it may
+// provide shortcuts for the common operations that don't need them all.
+type setView struct {
+  once        sync.Once
+  done        atomic.Bool
+  contents    []interface{}
+  materialize func() []interface{}
+  contains    func(value interface{}) bool // optional
+  cardinality func() int                   // optional
+  iterator    func() Iterator              // optional; must not yield duplicates
+}
+
+// elements returns the elements of the set, materializing a view if need be.
+func (set Set) elements() []interface{} {
+  if set.view == nil {
+    return set.contents
+  }
+  view := set.view
+  view.once.Do(func() {
+    view.contents = view.materialize()
+    view.done.Store(true)
+  })
+  return view.contents
+}
+
+// lazyView returns the set's view if its elements haven't been materialized
+// yet, or nil.
+func (set Set) lazyView() *setView {
+  if set.view == nil || set.view.done.Load() {
+    return nil
+  }
+  return set.view
 }
 
 // EmptySet is the empty set.
@@ -908,7 +3350,8 @@ NEXT_INPUT:
     }
     uniq = append(uniq, v)
   }
-  return Set{uniq}
+  runtimeStats.setSizes.record(len(uniq))
+  return Set{contents: uniq}
 }
 
 // Cardinality returns the cardinality (size) of the set.
@@ -918,17 +3361,34 @@ func (set Set) Cardinality() Int {
 
 // CardinalityInt returns the cardinality (size) of the set as an int.
 func (set Set) CardinalityInt() int {
-  return len(set.contents)
+  if view := set.lazyView(); view != nil && view.cardinality != nil {
+    return view.cardinality()
+  }
+  return len(set.elements())
 }
 
 // Contains returns whether the given value is an element of the set.
 func (set Set) Contains(value interface{}) bool {
-  return sliceContains(set.contents, value)
+  if view := set.lazyView(); view != nil && view.contains != nil {
+    return view.contains(value)
+  }
+  return sliceContains(set.elements(), value)
 }
 
 // Iterator returns an iterator over the elements of the set.
 func (set Set) Iterator() Iterator {
-  return sliceIterator(set.contents)
+  if view := set.lazyView(); view != nil && view.iterator != nil {
+    return view.iterator()
+  }
+  return sliceIterator(set.elements())
+}
+
+// All returns an iter.Seq over the elements of the set.
+func (set Set) All() iter.Seq[interface{}] {
+  if view := set.lazyView(); view != nil && view.iterator != nil {
+    return ToIterSeq(view.iterator())
+  }
+  return sliceAll(set.elements())
 }
 
 // Union makes a set containing each element contained by either input set.
@@ -942,9 +3402,9 @@ func (set Set) Union(set2 Set) Set {
 
   n := set.CardinalityInt()
   uniq := make([]interface{}, n)
-  copy(uniq, set.contents)
+  copy(uniq, set.elements())
 NEXT_INPUT:
-  for _, v := range set2.contents {
+  for _, v := range set2.elements() {
     for _, u := range uniq {
       if AreEqual(u, v) {
         continue NEXT_INPUT
@@ -953,7 +3413,8 @@ NEXT_INPUT:
     uniq = append(uniq, v)
   }
 
-  return Set{uniq}
+  runtimeStats.setSizes.record(len(uniq))
+  return Set{contents: uniq}
 }
 
 // Intersection makes a set containing each element contained by both input
@@ -964,13 +3425,14 @@ func (set Set) Intersection(set2 Set) Set {
   }
 
   uniq := make([]interface{}, 0)
-  for _, v := range set.contents {
+  for _, v := range set.elements() {
     if set2.Contains(v) {
       uniq = append(uniq, v)
     }
   }
 
-  return Set{uniq}
+  runtimeStats.setSizes.record(len(uniq))
+  return Set{contents: uniq}
 }
 
 // Difference makes a set containing each element contained by set but not
@@ -981,13 +3443,14 @@ func (set Set) Difference(set2 Set) Set {
   }
 
   elts := make([]interface{}, 0, max(0, set.CardinalityInt()-set2.CardinalityInt()))
-  for _, v := range set.contents {
+  for _, v := range set.elements() {
     if !set2.Contains(v) {
       elts = append(elts, v)
     }
   }
 
-  return Set{elts}
+  runtimeStats.setSizes.record(len(elts))
+  return Set{contents: elts}
 }
 
 // IsDisjointFrom returns true if the sets have no elements in common.
@@ -996,8 +3459,8 @@ func (set Set) IsDisjointFrom(set2 Set) bool {
     return true
   }
 
-  for _, v := range set.contents {
-    if sliceContains(set2.contents, v) {
+  for _, v := range set.elements() {
+    if set2.Contains(v) {
       return false
     }
   }
@@ -1013,8 +3476,14 @@ func (set Set) Equals(set2 Set) bool {
 
 // EqualsGeneric implements the EqualsGeneric interface.
 func (set Set) EqualsGeneric(other interface{}) bool {
-  set2, ok := other.(Set)
-  return ok && set.Equals(set2)
+  switch set2 := other.(type) {
+  case Set:
+    return set.Equals(set2)
+  case SortedSet:
+    return set.Equals(set2.Set())
+  default:
+    return false
+  }
 }
 
 // IsSubsetOf returns true if each element in this set is also in the other.
@@ -1031,8 +3500,8 @@ func (set Set) IsProperSubsetOf(set2 Set) bool {
 }
 
 func (set Set) isSubsetAfterCardinalityCheck(set2 Set) bool {
-  for _, v := range set.contents {
-    if !sliceContains(set2.contents, v) {
+  for _, v := range set.elements() {
+    if !set2.Contains(v) {
       return false
     }
   }
@@ -1044,46 +3513,183 @@ func (set Set) Elements() Set {
   return set
 }
 
-// AllSubsets returns an iterator over all subsets of the given set.
+// AllSubsets returns an iterator over all subsets of the given set.  The
+// subsets come in the order of a binary counter whose ith bit says whether the
+// ith element is included.
 func (set Set) AllSubsets() Iterator {
-  // Use a big integer to range from 0 to 2^n
-  r := new(big.Int)
-  limit := new(big.Int).Lsh(One.impl, uint(set.CardinalityInt()))
+  members := make([]bool, len(set.elements()))
+  done := false
+  return func() (interface{}, bool) {
+    CheckCanceled()
+    if done {
+      return Set{}, false
+    }
+    ans := set.subsetOf(members)
+    _, done = incrementBits(members)
+    return ans, true
+  }
+}
+
+// GraySubsets returns an iterator over all subsets of the given set, in
+// Gray-code order: each subset differs from the previous one by a single
+// element.
+func (set Set) GraySubsets() Iterator {
+  members := make([]bool, len(set.elements()))
+  counter := make([]bool, len(set.elements()))
+  started, done := false, false
   return func() (interface{}, bool) {
-    if r.Cmp(limit) == 0 {
+    CheckCanceled()
+    if done {
+      return Set{}, false
+    }
+    if started {
+      // The bit that a binary counter sets on its next step is the one that
+      // flips in the Gray code
+      var flip int
+      flip, done = incrementBits(counter)
+      if done {
+        return Set{}, false
+      }
+      members[flip] = !members[flip]
+    }
+    started = true
+    return set.subsetOf(members), true
+  }
+}
+
+// SubsetsOfSize returns an iterator over the subsets of the given set that
+// have exactly k elements, in revolving-door order: each subset differs from
+// the previous one by swapping one element for another.
+func (set Set) SubsetsOfSize(k int) Iterator {
+  n := len(set.elements())
+  if k < 0 || k > n {
+    return func() (interface{}, bool) {
       return Set{}, false
+    }
+  }
+  if k == 0 {
+    return SingleValue(EmptySet)
+  }
+
+  // This is Algorithm R of Knuth, TAOCP 7.2.1.3, with c[1..k] holding the
+  // indices of the chosen elements in increasing order, and c[k+1] = n as a
+  // sentinel
+  c := make([]int, k+2)
+  for j := 1; j <= k; j++ {
+    c[j] = j - 1
+  }
+  c[k+1] = n
+  step := func() bool {
+    var j int
+    if k%2 == 1 {
+      if c[1]+1 < c[2] {
+        c[1]++
+        return true
+      }
+      j = 2
     } else {
-      values := make([]interface{}, 0, len(set.contents))
-      i := 0
-      s := new(big.Int).Set(r)
-      mod := new(big.Int)
-      for s.Cmp(Zero.impl) > 0 {
-        if mod.Mod(s, Two.impl).Cmp(Zero.impl) != 0 {
-          values = append(values, set.contents[i])
-        }
-        s.Div(s, Two.impl)
-        i++
+      if c[1] > 0 {
+        c[1]--
+        return true
       }
-      r.Add(r, One.impl)
+      j = 2
+      goto increase
+    }
+  decrease:
+    if j > k {
+      return false
+    }
+    if c[j] >= j {
+      c[j] = c[j-1]
+      c[j-1] = j - 2
+      return true
+    }
+    j++
+  increase:
+    if j > k {
+      return false
+    }
+    if c[j]+1 < c[j+1] {
+      c[j-1] = c[j]
+      c[j]++
+      return true
+    }
+    j++
+    goto decrease
+  }
 
-      // Annoyingly, the other implementations reverse the order of the
-      // elements, so we have to as well
-      return Set{reverse(values)}, true
+  members := make([]bool, n)
+  started, done := false, false
+  return func() (interface{}, bool) {
+    CheckCanceled()
+    if done {
+      return Set{}, false
+    }
+    if started && !step() {
+      done = true
+      return Set{}, false
     }
+    started = true
+    for i := range members {
+      members[i] = false
+    }
+    for j := 1; j <= k; j++ {
+      members[c[j]] = true
+    }
+    return set.subsetOf(members), true
   }
 }
 
-func reverse(values []interface{}) []interface{} {
-  ans := make([]interface{}, len(values))
-  n := len(values)
-  for i, v := range values {
-    ans[n-1-i] = v
+// SubsetsBetween returns an iterator over the subsets of the given set that
+// have at least lo and at most hi elements, ordered by size and then as by
+// SubsetsOfSize.
+func (set Set) SubsetsBetween(lo, hi int) Iterator {
+  k := max(lo, 0)
+  hi = min(hi, len(set.elements()))
+  var it Iterator
+  return func() (interface{}, bool) {
+    for k <= hi {
+      if it == nil {
+        it = set.SubsetsOfSize(k)
+      }
+      if v, ok := it(); ok {
+        return v, true
+      }
+      it = nil
+      k++
+    }
+    return Set{}, false
   }
-  return ans
+}
+
+// incrementBits adds one to a little-endian binary counter, returning the
+// index of the bit that was set and whether the counter wrapped around to zero.
+func incrementBits(bits []bool) (int, bool) {
+  for i := range bits {
+    if bits[i] {
+      bits[i] = false
+    } else {
+      bits[i] = true
+      return i, false
+    }
+  }
+  return -1, true
+}
+
+// subsetOf builds the subset with the given members.  Annoyingly, the other
+// implementations reverse the order of the elements, so we have to as well.
+func (set Set) subsetOf(members []bool) Set {
+  values := make([]interface{}, 0, len(members))
+  for i := len(members) - 1; i >= 0; i-- {
+    if members[i] {
+      values = append(values, set.elements()[i])
+    }
+  }
+  return Set{contents: values}
 }
 
 func (set Set) String() string {
-  return "{" + stringOfElements(set.contents) + "}"
+  return "{" + stringOfElements(set.elements()) + "}"
 }
 
 /******************************************************************************
@@ -1091,13 +3697,116 @@ func (set Set) String() string {
  ******************************************************************************/
 
 // A MultiSet is an unordered sequence of elements with possible duplication.
+// Each distinct element is stored once, with its multiplicity, in the order in
+// which it was first added; elements whose multiplicity drops to zero are
+// removed.  The elements are indexed by hash so that lookups don't have to
+// scan the whole multiset.
 type MultiSet struct {
-  elts []msetElt
+  elts  []msetElt
+  index map[uint64][]int // hash of value -> indices into elts
 }
 
 type msetElt struct {
   value interface{}
-  count Int
+  count msetCount
+}
+
+// An msetCount is a (positive) multiplicity.  It's held as an int64 unless it
+// is too large, in which case big is used instead.
+type msetCount struct {
+  small int64
+  big   *big.Int
+}
+
+var msetOne = msetCount{small: 1}
+
+func msetCountOf(n Int) msetCount {
+  if n.impl == nil {
+    // A zero-valued Int counts as zero, as in Int.hash
+    return msetCount{}
+  }
+  if n.impl.IsInt64() {
+    return msetCount{small: n.impl.Int64()}
+  }
+  return msetCount{big: n.impl}
+}
+
+func msetCountOfBig(n *big.Int) msetCount {
+  if n.IsInt64() {
+    return msetCount{small: n.Int64()}
+  }
+  return msetCount{big: n}
+}
+
+func (c msetCount) toBig() *big.Int {
+  if c.big != nil {
+    return c.big
+  }
+  return big.NewInt(c.small)
+}
+
+// Int returns the multiplicity as an Int.
+func (c msetCount) Int() Int {
+  if c.big != nil {
+    return intOf(c.big)
+  }
+  return IntOfInt64(c.small)
+}
+
+func (c msetCount) Sign() int {
+  if c.big != nil {
+    return c.big.Sign()
+  }
+  switch {
+  case c.small < 0:
+    return -1
+  case c.small > 0:
+    return 1
+  default:
+    return 0
+  }
+}
+
+func (c msetCount) Cmp(d msetCount) int {
+  if c.big == nil && d.big == nil {
+    switch {
+    case c.small < d.small:
+      return -1
+    case c.small > d.small:
+      return 1
+    default:
+      return 0
+    }
+  }
+  return c.toBig().Cmp(d.toBig())
+}
+
+func (c msetCount) Plus(d msetCount) msetCount {
+  if c.big == nil && d.big == nil {
+    sum := c.small + d.small
+    // Overflow iff both operands have the same sign and the sum's differs
+    if (c.small >= 0) != (d.small >= 0) || (sum >= 0) == (c.small >= 0) {
+      return msetCount{small: sum}
+    }
+  }
+  return msetCountOfBig(new(big.Int).Add(c.toBig(), d.toBig()))
+}
+
+func (c msetCount) Minus(d msetCount) msetCount {
+  if c.big == nil && d.big == nil {
+    diff := c.small - d.small
+    if (c.small >= 0) == (d.small >= 0) || (diff >= 0) == (c.small >= 0) {
+      return msetCount{small: diff}
+    }
+  }
+  return msetCountOfBig(new(big.Int).Sub(c.toBig(), d.toBig()))
+}
+
+func (c msetCount) Min(d msetCount) msetCount {
+  if c.Cmp(d) <= 0 {
+    return c
+  }
+  return d
 }
 
 // EmptyMultiSet is the empty multiset.
@@ -1105,18 +3814,12 @@ var EmptyMultiSet = MultiSetOf()
 
 // MultiSetOf creates a MultiSet with the given elements.
 func MultiSetOf(values ...interface{}) MultiSet {
-  elts := make([]msetElt, 0, len(values))
-NEXT_INPUT:
+  ans := newMultiSet(len(values))
   for _, v := range values {
-    for i, u := range elts {
-      if AreEqual(u.value, v) {
-        elts[i] = msetElt{value: u.value, count: u.count.Plus(One)}
-        continue NEXT_INPUT
-      }
-    }
-    elts = append(elts, msetElt{value: v, count: One})
+    ans.add(v, msetOne)
   }
-  return MultiSet{elts}
+  runtimeStats.multiSetSizes.record(len(ans.elts))
+  return ans
 }
 
 // MultiSetFromSeq creates a MultiSet from the elements in the given sequence.
@@ -1126,133 +3829,192 @@ func MultiSetFromSeq(seq Seq) MultiSet {
 
 // MultiSetFromSet creates a MultiSet from the elements in the given set.
 func MultiSetFromSet(set Set) MultiSet {
-  elts := make([]msetElt, len(set.contents))
-  for i, v := range set.contents {
+  ans := newMultiSet(len(set.elements()))
+  for _, v := range set.elements() {
     // No need to check whether it's already there because Set elements are
     // assumed to be unique
-    elts[i] = msetElt{v, One}
+    ans.appendElt(msetElt{v, msetOne})
+  }
+  return ans
+}
+
+func newMultiSet(capacity int) MultiSet {
+  return MultiSet{
+    elts:  make([]msetElt, 0, capacity),
+    index: make(map[uint64][]int, capacity),
   }
-  return MultiSet{elts}
 }
 
-func (mset MultiSet) clone() MultiSet {
-  elts := make([]msetElt, len(mset.elts))
-  copy(elts, mset.elts)
-  return MultiSet{elts}
+// appendElt adds an element that is known not to be present yet.  Only to be
+// used while a new multiset is being built.
+func (mset *MultiSet) appendElt(e msetElt) {
+  h := Hash(e.value)
+  mset.index[h] = append(mset.index[h], len(mset.elts))
+  mset.elts = append(mset.elts, e)
+}
+
+// add increases the multiplicity of a value by a positive count.  Only to be
+// used while a new multiset is being built.
+func (mset *MultiSet) add(value interface{}, count msetCount) {
+  if i, found := mset.findIndex(value); found {
+    mset.elts[i].count = mset.elts[i].count.Plus(count)
+  } else {
+    mset.appendElt(msetElt{value, count})
+  }
 }
 
 func (mset MultiSet) findIndex(value interface{}) (int, bool) {
-  for i, e := range mset.elts {
-    if AreEqual(e.value, value) {
+  for _, i := range mset.index[Hash(value)] {
+    if AreEqual(mset.elts[i].value, value) {
       return i, true
     }
   }
   return -1, false
 }
 
+func (mset MultiSet) count(value interface{}) msetCount {
+  if i, found := mset.findIndex(value); found {
+    return mset.elts[i].count
+  }
+  return msetCount{}
+}
+
 // Update changes the cardinality of the given value in the multiset, returning
 // a new multiset unless the cardinality did not actually change.
 func (mset MultiSet) Update(value interface{}, n Int) MultiSet {
+  count := msetCountOf(n)
   i, found := mset.findIndex(value)
-  if found {
-    if mset.elts[i].count == n {
-      return mset
-    } else {
-      ans := mset.clone()
-      ans.elts[i] = msetElt{value, n}
-      return ans
-    }
-  } else if n.Cmp(Zero) == 0 {
+  if found && mset.elts[i].count.Cmp(count) == 0 {
     return mset
-  } else {
-    return MultiSet{append(mset.clone().elts, msetElt{value, n})}
   }
+  if !found && count.Sign() == 0 {
+    return mset
+  }
+
+  ans := newMultiSet(len(mset.elts) + 1)
+  for j, e := range mset.elts {
+    if j == i {
+      if count.Sign() == 0 {
+        continue
+      }
+      e = msetElt{e.value, count}
+    }
+    ans.appendElt(e)
+  }
+  if !found {
+    ans.appendElt(msetElt{value, count})
+  }
+  return ans
+}
+
+func (mset MultiSet) cardinality() msetCount {
+  n := msetCount{}
+  for _, e := range mset.elts {
+    n = n.Plus(e.count)
+  }
+  return n
 }
 
 // Cardinality returns the number of elements in the multiset (counting
 // repetitions).
 func (mset MultiSet) Cardinality() Int {
-  n := new(big.Int)
-  for _, e := range mset.elts {
-    n.Add(n, e.count.impl)
-  }
-  return intOf(n)
+  return mset.cardinality().Int()
 }
 
 // CardinalityInt returns the number of elements in the multiset (counting
-// repetitions) as an int.
+// repetitions) as an int.  Panics if the cardinality is out of int range.
 func (mset MultiSet) CardinalityInt() int {
-  n := 0
-  for _, e := range mset.elts {
-    n += e.count.Int()
+  n := mset.cardinality()
+  if n.big != nil || n.small > math.MaxInt {
+    panic("multiset cardinality does not fit in an int: " + n.Int().String())
   }
-  return n
+  return int(n.small)
 }
 
-// Index returns the ith element of the multiset, which is arbitrary except that
-// it is different from the jth element when i /= j.  (Repetitions are ignored.)
+// Index returns the ith distinct element of the multiset, in the same order
+// as UniqueElements.  (Repetitions are ignored.)
 func (mset MultiSet) Index(i Int) interface{} {
-  return mset.elts[i.Int()]
+  return mset.elts[i.Int()].value
 }
 
-// Iterator returns an iterator over the multiset (including repetitions).
-func (mset MultiSet) Iterator() Iterator {
-  i := 0
-  n := new(big.Int)
-  return func() (interface{}, bool) {
-    for {
-      if i >= len(mset.elts) {
-        return nil, false
-      }
-      if n.Cmp(mset.elts[i].count.impl) >= 0 {
-        n.SetInt64(0)
-        i++
+// Iterator returns an iterator over the multiset (including repetitions).
+func (mset MultiSet) Iterator() Iterator {
+  return mset.Elements()
+}
+
+// All returns an iter.Seq over the multiset (including repetitions).
+func (mset MultiSet) All() iter.Seq[interface{}] {
+  return func(yield func(interface{}) bool) {
+    for _, e := range mset.elts {
+      if e.count.big == nil {
+        for n := int64(0); n < e.count.small; n++ {
+          CheckCanceled()
+          if !yield(e.value) {
+            return
+          }
+        }
       } else {
-        break
+        for n := new(big.Int); n.Cmp(e.count.big) < 0; n.Add(n, One.impl) {
+          CheckCanceled()
+          if !yield(e.value) {
+            return
+          }
+        }
       }
     }
+  }
+}
 
-    ans := mset.elts[i].value
-    n.Add(n, One.impl)
-    return ans, true
+// Multiplicities returns an iter.Seq2 over the distinct elements of the
+// multiset, in the same order as UniqueElements, paired with their
+// multiplicities.
+func (mset MultiSet) Multiplicities() iter.Seq2[interface{}, Int] {
+  return func(yield func(interface{}, Int) bool) {
+    for _, e := range mset.elts {
+      if !yield(e.value, e.count.Int()) {
+        return
+      }
+    }
   }
 }
 
+// Counts is the same as Multiplicities.
+func (mset MultiSet) Counts() iter.Seq2[interface{}, Int] {
+  return mset.Multiplicities()
+}
+
 // Contains returns whether the multiset contains the given element (at least
 // once).
 func (mset MultiSet) Contains(value interface{}) bool {
-  return mset.Multiplicity(value).Cmp(Zero) > 0
+  _, found := mset.findIndex(value)
+  return found
 }
 
 // Multiplicity returns the number of times a given element occurs in the
 // multiset.
 func (mset MultiSet) Multiplicity(value interface{}) Int {
-  i, found := mset.findIndex(value)
-  if found {
-    return mset.elts[i].count
-  } else {
-    return Zero
-  }
+  return mset.count(value).Int()
 }
 
 // Elements returns an iterator that yields each element in the multiset, as
 // many times as it appears.
 func (mset MultiSet) Elements() func() (interface{}, bool) {
   i := 0
-  n := new(big.Int)
+  n := msetCount{}
   return func() (interface{}, bool) {
+    CheckCanceled()
     for {
       if i >= len(mset.elts) {
         return nil, false
       }
-      if n.Cmp(mset.elts[i].count.impl) == 0 {
+      if n.Cmp(mset.elts[i].count) >= 0 {
         i++
-        n.SetInt64(0)
+        n = msetCount{}
       } else {
         break
       }
     }
-    n.Add(n, One.impl)
+    n = n.Plus(msetOne)
     return mset.elts[i].value, true
   }
 }
@@ -1281,22 +4043,14 @@ func (mset MultiSet) Union(mset2 MultiSet) MultiSet {
     return mset
   }
 
-  elts := make([]msetElt, 0, len(mset.elts)+len(mset2.elts))
+  ans := newMultiSet(len(mset.elts) + len(mset2.elts))
   for _, e := range mset.elts {
-    if e.count.Cmp(Zero) == 0 {
-      // e.value in mset2 will be added in the next separate for loop
-      continue
-    }
-    m := mset2.Multiplicity(e.value)
-    elts = append(elts, msetElt{e.value, e.count.Plus(m)})
+    ans.appendElt(e)
   }
   for _, e := range mset2.elts {
-    if !mset.Contains(e.value) {
-      elts = append(elts, e)
-    }
+    ans.add(e.value, e.count)
   }
-
-  return MultiSet{elts}
+  return ans
 }
 
 // Intersection returns a multiset including those elements which occur in both
@@ -1307,15 +4061,14 @@ func (mset MultiSet) Intersection(mset2 MultiSet) MultiSet {
     return EmptyMultiSet
   }
 
-  elts := make([]msetElt, 0)
+  ans := newMultiSet(min(len(mset.elts), len(mset2.elts)))
   for _, e := range mset.elts {
-    m := mset2.Multiplicity(e.value)
-    if m.Cmp(Zero) != 0 {
-      elts = append(elts, msetElt{e.value, e.count.Min(m)})
+    m := mset2.count(e.value)
+    if m.Sign() != 0 {
+      ans.appendElt(msetElt{e.value, e.count.Min(m)})
     }
   }
-
-  return MultiSet{elts}
+  return ans
 }
 
 // Difference returns a multiset including those elements which occur in the
@@ -1326,15 +4079,14 @@ func (mset MultiSet) Difference(mset2 MultiSet) MultiSet {
     return mset
   }
 
-  elts := make([]msetElt, 0, max(0, len(mset.elts)-len(mset2.elts)))
+  ans := newMultiSet(len(mset.elts))
   for _, e := range mset.elts {
-    d := e.count.Minus(mset2.Multiplicity(e.value))
-    if d.Cmp(Zero) > 0 {
-      elts = append(elts, msetElt{e.value, d})
+    d := e.count.Minus(mset2.count(e.value))
+    if d.Sign() > 0 {
+      ans.appendElt(msetElt{e.value, d})
     }
   }
-
-  return MultiSet{elts}
+  return ans
 }
 
 // IsDisjointFrom returns whether two multisets contain no elements in common.
@@ -1344,7 +4096,7 @@ func (mset MultiSet) IsDisjointFrom(mset2 MultiSet) bool {
   }
 
   for _, e := range mset.elts {
-    if (e.count.Cmp(Zero) != 0) && mset2.Contains(e.value) {
+    if mset2.Contains(e.value) {
       return false
     }
   }
@@ -1355,13 +4107,15 @@ func (mset MultiSet) IsDisjointFrom(mset2 MultiSet) bool {
 // Equals returns whether two multisets have the same values with the same
 // multiplicities.
 func (mset MultiSet) Equals(mset2 MultiSet) bool {
+  if len(mset.elts) != len(mset2.elts) {
+    return false
+  }
   for _, e := range mset.elts {
-    m := mset2.Multiplicity(e.value)
-    if e.count.Cmp(m) != 0 {
+    if e.count.Cmp(mset2.count(e.value)) != 0 {
       return false
     }
   }
-  return mset.CardinalityInt() == mset2.CardinalityInt()
+  return true
 }
 
 // EqualsGeneric implements the EqualsGeneric interface.
@@ -1374,8 +4128,7 @@ func (mset MultiSet) EqualsGeneric(other interface{}) bool {
 // other, with lesser or equal multiplicities.
 func (mset MultiSet) IsSubsetOf(mset2 MultiSet) bool {
   for _, e := range mset.elts {
-    m := mset2.Multiplicity(e.value)
-    if e.count.Cmp(m) > 0 {
+    if e.count.Cmp(mset2.count(e.value)) > 0 {
       return false
     }
   }
@@ -1385,18 +4138,15 @@ func (mset MultiSet) IsSubsetOf(mset2 MultiSet) bool {
 // IsProperSubsetOf returns whether one multiset has a proper subset of the
 // elements of the other, with strictly lesser multiplicities.
 func (mset MultiSet) IsProperSubsetOf(mset2 MultiSet) bool {
-  return mset.IsSubsetOf(mset2) && mset.CardinalityInt() < mset2.CardinalityInt()
+  return mset.IsSubsetOf(mset2) && mset.cardinality().Cmp(mset2.cardinality()) < 0
 }
 
 func (mset MultiSet) String() string {
   s := "multiset{"
   sep := ""
-  i := new(big.Int)
-  for _, e := range mset.elts {
-    for i.SetInt64(0); i.Cmp(e.count.impl) < 0; i.Add(i, One.impl) {
-      s += sep + String(e.value)
-      sep = ", "
-    }
+  for v := range mset.All() {
+    s += sep + StringOfElement(v)
+    sep = ", "
   }
   s += "}"
   return s
@@ -1415,23 +4165,93 @@ type mapElt struct {
   key, value interface{}
 }
 
-// A MapBuilder creates a new Map by accumulating elements imperatively.
-type MapBuilder []mapElt
+// A MapBuilder creates a new Map by accumulating elements imperatively.  Each
+// key occurs only once in the result: adding a key again replaces its value,
+// as in a map display.  A strict MapBuilder instead halts when a key is given
+// two different values, as a map comprehension must be functional.
+type MapBuilder struct {
+  elts   []mapElt
+  index  map[uint64][]int // hash of key -> indices into elts
+  strict bool
+  shared bool // whether elts is also held by a Map returned from ToMap
+}
 
 // NewMapBuilder creates a new map builder.
 func NewMapBuilder() *MapBuilder {
-  return new(MapBuilder)
+  return &MapBuilder{index: make(map[uint64][]int)}
+}
+
+// NewStrictMapBuilder creates a new map builder in strict mode.
+func NewStrictMapBuilder() *MapBuilder {
+  mb := NewMapBuilder()
+  mb.strict = true
+  return mb
+}
+
+func (mb *MapBuilder) findIndex(key interface{}, h uint64) (int, bool) {
+  for _, i := range mb.index[h] {
+    if AreEqual(mb.elts[i].key, key) {
+      return i, true
+    }
+  }
+  return -1, false
 }
 
 // Add adds a key and value to the map being built.
 func (mb *MapBuilder) Add(k, v interface{}) *MapBuilder {
-  *mb = append(*mb, mapElt{k, v})
+  h := Hash(k)
+  if i, found := mb.findIndex(k, h); found {
+    old := mb.elts[i].value
+    if mb.strict && !AreEqual(old, v) {
+      panic(fmt.Sprintf("map comprehension maps key %s to two different values: %s and %s", String(k), String(old), String(v)))
+    }
+    if mb.shared {
+      // Don't mutate the map we already handed out
+      elts := make([]mapElt, len(mb.elts), cap(mb.elts))
+      copy(elts, mb.elts)
+      mb.elts = elts
+      mb.shared = false
+    }
+    mb.elts[i].value = v
+  } else {
+    mb.index[h] = append(mb.index[h], len(mb.elts))
+    mb.elts = append(mb.elts, mapElt{k, v})
+  }
   return mb
 }
 
+// Len returns the number of distinct keys added so far.
+func (mb *MapBuilder) Len() int {
+  return len(mb.elts)
+}
+
+// Reserve makes room for at least n more keys.
+func (mb *MapBuilder) Reserve(n int) {
+  if len(mb.elts) == 0 {
+    mb.index = make(map[uint64][]int, n)
+  }
+  if n > cap(mb.elts)-len(mb.elts) {
+    // The storage gets copied, so it's no longer shared with any map
+    mb.elts = reserve(mb.elts, n)
+    mb.shared = false
+  }
+}
+
+// Reset discards the accumulated keys and values.  The strictness of the
+// builder is kept.
+func (mb *MapBuilder) Reset() {
+  mb.elts = nil
+  mb.index = make(map[uint64][]int)
+  mb.shared = false
+}
+
 // ToMap gets the map out of the map builder.
 func (mb *MapBuilder) ToMap() Map {
-  return Map{*mb}
+  // Clip the capacity so that later additions don't share storage with the map
+  mb.elts = mb.elts[:len(mb.elts):len(mb.elts)]
+  mb.shared = true
+  runtimeStats.mapSizes.record(len(mb.elts))
+  return Map{mb.elts}
 }
 
 // EmptyMap is the empty map.
@@ -1440,6 +4260,7 @@ var EmptyMap = NewMapBuilder().ToMap()
 func (m Map) clone() Map {
   elts := make([]mapElt, len(m.elts))
   copy(elts, m.elts)
+  runtimeStats.mapSizes.record(len(elts))
   return Map{elts}
 }
 
@@ -1462,6 +4283,18 @@ func (m Map) CardinalityInt() int {
   return len(m.elts)
 }
 
+// All returns an iter.Seq2 over the keys of the map and their associated
+// values.
+func (m Map) All() iter.Seq2[interface{}, interface{}] {
+  return func(yield func(interface{}, interface{}) bool) {
+    for _, e := range m.elts {
+      if !yield(e.key, e.value) {
+        return
+      }
+    }
+  }
+}
+
 // Find finds the given key in the map, returning it and a success flag.
 func (m Map) Find(key interface{}) (interface{}, bool) {
   i, found := m.findIndex(key)
@@ -1512,6 +4345,7 @@ func (a Map) Merge(b Map) Map {
       m = append(m, e)
     }
   }
+  runtimeStats.mapSizes.record(len(m))
   return Map{m}
 }
 
@@ -1520,72 +4354,523 @@ func (a Map) Subtract(keys Set) Map {
     return a
   }
 
-  mb := NewMapBuilder()
+  elts := make([]mapElt, 0, len(a.elts))
   for _, e := range a.elts {
     if !keys.Contains(e.key) {
-      *mb = append(*mb, e)
+      elts = append(elts, e)
+    }
+  }
+  runtimeStats.mapSizes.record(len(elts))
+  return Map{elts}
+}
+
+// Equals returns whether each map associates the same keys to the same values.
+func (m Map) Equals(m2 Map) bool {
+  if len(m.elts) != len(m2.elts) {
+    return false
+  }
+  for _, e := range m.elts {
+    i, found := m2.findIndex(e.key)
+    if !found || !AreEqual(e.value, m2.elts[i].value) {
+      return false
+    }
+  }
+  return true
+}
+
+// EqualsGeneric implements the EqualsGeneric interface.
+func (m Map) EqualsGeneric(other interface{}) bool {
+  switch m2 := other.(type) {
+  case Map:
+    return m.Equals(m2)
+  case SortedMap:
+    return m.Equals(m2.Map())
+  default:
+    return false
+  }
+}
+
+// Keys returns the set of keys in the map.  The set is a view of the map, so
+// membership tests and iteration don't need to build it.
+func (m Map) Keys() Set {
+  return Set{view: &setView{
+    materialize: func() []interface{} {
+      keys := make([]interface{}, len(m.elts))
+      for i, e := range m.elts {
+        keys[i] = e.key
+      }
+      return keys
+    },
+    contains:    m.Contains,
+    cardinality: m.CardinalityInt,
+    iterator: func() Iterator {
+      i := 0
+      return func() (interface{}, bool) {
+        if i >= len(m.elts) {
+          return nil, false
+        }
+        i++
+        return m.elts[i-1].key, true
+      }
+    },
+  }}
+}
+
+// Values returns the set of values in the map.  The set is a view of the map,
+// so membership tests don't need to build it.
+func (m Map) Values() Set {
+  return Set{view: &setView{
+    materialize: func() []interface{} {
+      b := NewBuilder()
+      b.Reserve(len(m.elts))
+      for _, e := range m.elts {
+        b.Add(e.value)
+      }
+      return b.ToSet().contents
+    },
+    contains: func(value interface{}) bool {
+      for _, e := range m.elts {
+        if AreEqual(e.value, value) {
+          return true
+        }
+      }
+      return false
+    },
+  }}
+}
+
+// Items returns the set of items in the map as a Set of Tuples.  The set is a
+// view of the map, so membership tests and iteration don't need to build it.
+func (m Map) Items() Set {
+  return Set{view: &setView{
+    materialize: func() []interface{} {
+      items := make([]interface{}, len(m.elts))
+      for i, e := range m.elts {
+        items[i] = TupleOf(e.key, e.value)
+      }
+      return items
+    },
+    contains: func(value interface{}) bool {
+      item, ok := value.(Tuple)
+      if !ok || len(item.contents) != 2 {
+        return false
+      }
+      v, found := m.Find(item.contents[0])
+      return found && AreEqual(v, item.contents[1])
+    },
+    cardinality: m.CardinalityInt,
+    iterator: func() Iterator {
+      i := 0
+      return func() (interface{}, bool) {
+        if i >= len(m.elts) {
+          return nil, false
+        }
+        i++
+        return TupleOf(m.elts[i-1].key, m.elts[i-1].value), true
+      }
+    },
+  }}
+}
+
+func (m Map) String() string {
+  s := "map["
+  for i, e := range m.elts {
+    if i > 0 {
+      s += ", "
+    }
+    s += fmt.Sprintf("%s := %s", StringOfElement(e.key), StringOfElement(e.value))
+  }
+  s += "]"
+  return s
+}
+
+/******************************************************************************
+ * Sorted sets and maps
+ ******************************************************************************/
+
+// A SortedSet is a set whose elements are kept in the order given by Compare,
+// which allows for range queries.  It is equal (by AreEqual) to the Set with
+// the same elements, and its Set method converts it without copying, so that
+// it can be passed back to Dafny code.
+type SortedSet struct {
+  contents []interface{} // sorted, without duplicates
+}
+
+// EmptySortedSet is the empty sorted set.
+var EmptySortedSet = SortedSet{}
+
+// SortedSetOf creates a sorted set with the given values.
+func SortedSetOf(values ...interface{}) SortedSet {
+  sorted := sortedValues(values)
+  uniq := make([]interface{}, 0, len(sorted))
+  for _, v := range sorted {
+    if len(uniq) == 0 || Compare(uniq[len(uniq)-1], v) != 0 {
+      uniq = append(uniq, v)
     }
   }
-  return mb.ToMap()
+  return SortedSet{uniq}
+}
+
+// SortedSetFrom creates a sorted set with the elements of a Set.
+func SortedSetFrom(set Set) SortedSet {
+  return SortedSet{sortedValues(set.elements())}
+}
+
+// Set returns the elements as an ordinary Set, which iterates over them in
+// sorted order.
+func (set SortedSet) Set() Set {
+  return Set{contents: set.contents}
+}
+
+// search returns the index of the first element not less than value, and
+// whether that element is equal to value.
+func (set SortedSet) search(value interface{}) (int, bool) {
+  i := sort.Search(len(set.contents), func(i int) bool {
+    return Compare(set.contents[i], value) >= 0
+  })
+  return i, i < len(set.contents) && Compare(set.contents[i], value) == 0
+}
+
+// Cardinality returns the cardinality (size) of the set.
+func (set SortedSet) Cardinality() Int {
+  return IntOf(len(set.contents))
+}
+
+// CardinalityInt returns the cardinality (size) of the set as an int.
+func (set SortedSet) CardinalityInt() int {
+  return len(set.contents)
+}
+
+// Contains returns whether the given value is an element of the set.
+func (set SortedSet) Contains(value interface{}) bool {
+  _, found := set.search(value)
+  return found
+}
+
+// Iterator returns an iterator over the elements of the set, in order.
+func (set SortedSet) Iterator() Iterator {
+  return sliceIterator(set.contents)
+}
+
+// All returns an iter.Seq over the elements of the set, in order.
+func (set SortedSet) All() iter.Seq[interface{}] {
+  return sliceAll(set.contents)
+}
+
+// Insert returns a sorted set that also contains the given value.
+func (set SortedSet) Insert(value interface{}) SortedSet {
+  i, found := set.search(value)
+  if found {
+    return set
+  }
+  arr := make([]interface{}, len(set.contents)+1)
+  copy(arr, set.contents[:i])
+  arr[i] = value
+  copy(arr[i+1:], set.contents[i:])
+  return SortedSet{arr}
+}
+
+// Remove returns a sorted set that doesn't contain the given value.
+func (set SortedSet) Remove(value interface{}) SortedSet {
+  i, found := set.search(value)
+  if !found {
+    return set
+  }
+  arr := make([]interface{}, len(set.contents)-1)
+  copy(arr, set.contents[:i])
+  copy(arr[i:], set.contents[i+1:])
+  return SortedSet{arr}
+}
+
+// Min returns the least element of the set, if there is one.
+func (set SortedSet) Min() (interface{}, bool) {
+  if len(set.contents) == 0 {
+    return nil, false
+  }
+  return set.contents[0], true
+}
+
+// Max returns the greatest element of the set, if there is one.
+func (set SortedSet) Max() (interface{}, bool) {
+  if len(set.contents) == 0 {
+    return nil, false
+  }
+  return set.contents[len(set.contents)-1], true
+}
+
+// Floor returns the greatest element less than or equal to the given value, if
+// there is one.
+func (set SortedSet) Floor(value interface{}) (interface{}, bool) {
+  i, found := set.search(value)
+  if found {
+    return set.contents[i], true
+  }
+  if i == 0 {
+    return nil, false
+  }
+  return set.contents[i-1], true
+}
+
+// Ceiling returns the least element greater than or equal to the given value,
+// if there is one.
+func (set SortedSet) Ceiling(value interface{}) (interface{}, bool) {
+  i, _ := set.search(value)
+  if i == len(set.contents) {
+    return nil, false
+  }
+  return set.contents[i], true
+}
+
+// bounds returns the indices of the elements from lo up to (but not including)
+// hi, where a nil bound means no bound.
+func (set SortedSet) bounds(lo, hi interface{}) (int, int) {
+  from, to := 0, len(set.contents)
+  if lo != nil {
+    from, _ = set.search(lo)
+  }
+  if hi != nil {
+    to, _ = set.search(hi)
+  }
+  return from, max(from, to)
+}
+
+// Range returns an iter.Seq over the elements from lo up to (but not
+// including) hi, in order.  A nil bound means there is no bound on that side.
+func (set SortedSet) Range(lo, hi interface{}) iter.Seq[interface{}] {
+  from, to := set.bounds(lo, hi)
+  return sliceAll(set.contents[from:to])
+}
+
+// Equals tests whether the sets contain the same elements.
+func (set SortedSet) Equals(set2 SortedSet) bool {
+  return compareSlices(set.contents, set2.contents) == 0
+}
+
+// EqualsGeneric implements the EqualsGeneric interface.  A SortedSet is equal
+// to a Set with the same elements.
+func (set SortedSet) EqualsGeneric(other interface{}) bool {
+  switch set2 := other.(type) {
+  case SortedSet:
+    return set.Equals(set2)
+  case Set:
+    return set.Set().Equals(set2)
+  default:
+    return false
+  }
+}
+
+// Hash implements the Hashable interface, agreeing with the hash of a Set.
+func (set SortedSet) Hash() uint64 {
+  return set.Set().hash()
+}
+
+func (set SortedSet) String() string {
+  return set.Set().String()
+}
+
+// A SortedMap is a map whose keys are kept in the order given by Compare,
+// which allows for range queries.  It is equal (by AreEqual) to the Map with
+// the same associations, and its Map method converts it without copying, so
+// that it can be passed back to Dafny code.
+type SortedMap struct {
+  elts []mapElt // sorted by key
+}
+
+// EmptySortedMap is the empty sorted map.
+var EmptySortedMap = SortedMap{}
+
+// SortedMapFrom creates a sorted map with the associations of a Map.
+func SortedMapFrom(m Map) SortedMap {
+  elts := make([]mapElt, len(m.elts))
+  copy(elts, m.elts)
+  sort.SliceStable(elts, func(i, j int) bool {
+    return Compare(elts[i].key, elts[j].key) < 0
+  })
+  return SortedMap{elts}
+}
+
+// Map returns the associations as an ordinary Map, which iterates over them
+// in key order.
+func (m SortedMap) Map() Map {
+  return Map{m.elts}
+}
+
+func (m SortedMap) search(key interface{}) (int, bool) {
+  i := sort.Search(len(m.elts), func(i int) bool {
+    return Compare(m.elts[i].key, key) >= 0
+  })
+  return i, i < len(m.elts) && Compare(m.elts[i].key, key) == 0
+}
+
+// Cardinality finds the number of elements in the map.
+func (m SortedMap) Cardinality() Int {
+  return IntOf(len(m.elts))
+}
+
+// CardinalityInt finds the number of elements in the map as an int.
+func (m SortedMap) CardinalityInt() int {
+  return len(m.elts)
+}
+
+// Find finds the given key in the map, returning its value and a success flag.
+func (m SortedMap) Find(key interface{}) (interface{}, bool) {
+  i, found := m.search(key)
+  if !found {
+    return nil, false
+  }
+  return m.elts[i].value, true
+}
+
+// Get finds the given key in the map, returning its value or nil.
+func (m SortedMap) Get(key interface{}) interface{} {
+  v, _ := m.Find(key)
+  return v
+}
+
+// Contains returns whether the given key is in the map.
+func (m SortedMap) Contains(key interface{}) bool {
+  _, found := m.search(key)
+  return found
+}
+
+// Update returns a new sorted map which associates the given key and value.
+func (m SortedMap) Update(key, value interface{}) SortedMap {
+  i, found := m.search(key)
+  if found {
+    elts := make([]mapElt, len(m.elts))
+    copy(elts, m.elts)
+    elts[i] = mapElt{key, value}
+    return SortedMap{elts}
+  }
+  elts := make([]mapElt, len(m.elts)+1)
+  copy(elts, m.elts[:i])
+  elts[i] = mapElt{key, value}
+  copy(elts[i+1:], m.elts[i:])
+  return SortedMap{elts}
+}
+
+// Remove returns a new sorted map without the given key.
+func (m SortedMap) Remove(key interface{}) SortedMap {
+  i, found := m.search(key)
+  if !found {
+    return m
+  }
+  elts := make([]mapElt, len(m.elts)-1)
+  copy(elts, m.elts[:i])
+  copy(elts[i:], m.elts[i+1:])
+  return SortedMap{elts}
+}
+
+func (m SortedMap) entry(i int) (interface{}, interface{}, bool) {
+  if i < 0 || i >= len(m.elts) {
+    return nil, nil, false
+  }
+  return m.elts[i].key, m.elts[i].value, true
+}
+
+// Min returns the least key of the map and its value, if there is one.
+func (m SortedMap) Min() (interface{}, interface{}, bool) {
+  return m.entry(0)
+}
+
+// Max returns the greatest key of the map and its value, if there is one.
+func (m SortedMap) Max() (interface{}, interface{}, bool) {
+  return m.entry(len(m.elts) - 1)
+}
+
+// Floor returns the greatest key less than or equal to the given one, and its
+// value, if there is one.
+func (m SortedMap) Floor(key interface{}) (interface{}, interface{}, bool) {
+  i, found := m.search(key)
+  if found {
+    return m.entry(i)
+  }
+  return m.entry(i - 1)
+}
+
+// Ceiling returns the least key greater than or equal to the given one, and
+// its value, if there is one.
+func (m SortedMap) Ceiling(key interface{}) (interface{}, interface{}, bool) {
+  i, _ := m.search(key)
+  return m.entry(i)
+}
+
+// All returns an iter.Seq2 over the keys of the map, in order, and their
+// associated values.
+func (m SortedMap) All() iter.Seq2[interface{}, interface{}] {
+  return m.Map().All()
+}
+
+// Range returns an iter.Seq2 over the keys from lo up to (but not including)
+// hi, in order, and their associated values.  A nil bound means there is no
+// bound on that side.
+func (m SortedMap) Range(lo, hi interface{}) iter.Seq2[interface{}, interface{}] {
+  from, to := 0, len(m.elts)
+  if lo != nil {
+    from, _ = m.search(lo)
+  }
+  if hi != nil {
+    to, _ = m.search(hi)
+  }
+  return Map{m.elts[from:max(from, to)]}.All()
+}
+
+// Keys returns the sorted set of keys in the map.
+func (m SortedMap) Keys() SortedSet {
+  keys := make([]interface{}, len(m.elts))
+  for i, e := range m.elts {
+    keys[i] = e.key
+  }
+  return SortedSet{keys}
 }
 
 // Equals returns whether each map associates the same keys to the same values.
-func (m Map) Equals(m2 Map) bool {
+func (m SortedMap) Equals(m2 SortedMap) bool {
   if len(m.elts) != len(m2.elts) {
     return false
   }
-  for _, e := range m.elts {
-    i, found := m2.findIndex(e.key)
-    if !found || !AreEqual(e.value, m2.elts[i].value) {
+  for i, e := range m.elts {
+    if Compare(e.key, m2.elts[i].key) != 0 || !AreEqual(e.value, m2.elts[i].value) {
       return false
     }
   }
   return true
 }
 
-// EqualsGeneric implements the EqualsGeneric interface.
-func (m Map) EqualsGeneric(other interface{}) bool {
-  m2, ok := other.(Map)
-  return ok && m.Equals(m2)
+// EqualsGeneric implements the EqualsGeneric interface.  A SortedMap is equal
+// to a Map with the same associations.
+func (m SortedMap) EqualsGeneric(other interface{}) bool {
+  switch m2 := other.(type) {
+  case SortedMap:
+    return m.Equals(m2)
+  case Map:
+    return m.Map().Equals(m2)
+  default:
+    return false
+  }
 }
 
-// Keys returns the set of keys in the map.
-func (m Map) Keys() Set {
-  b := NewBuilder()
-  for _, e := range m.elts {
-    b.Add(e.key)
-  }
-  return b.ToSet()
+// Hash implements the Hashable interface, agreeing with the hash of a Map.
+func (m SortedMap) Hash() uint64 {
+  return m.Map().hash()
 }
 
-// Values returns the set of values in the map.
-func (m Map) Values() Set {
-  b := NewBuilder()
-  for _, e := range m.elts {
-    b.Add(e.value)
-  }
-  return b.ToSet()
+func (m SortedMap) String() string {
+  return m.Map().String()
 }
 
-// Items returns the set of items in the map as a Set of Tuples.
-func (m Map) Items() Set {
-  b := NewBuilder()
-  for _, e := range m.elts {
-    b.Add(TupleOf(e.key, e.value))
+func asSet(x interface{}) Set {
+  if set, ok := x.(SortedSet); ok {
+    return set.Set()
   }
-  return b.ToSet()
+  return x.(Set)
 }
 
-func (m Map) String() string {
-  s := "map["
-  for i, e := range m.elts {
-    if i > 0 {
-      s += ", "
-    }
-    s += fmt.Sprintf("%s := %s", String(e.key), String(e.value))
+func asMap(x interface{}) Map {
+  if m, ok := x.(SortedMap); ok {
+    return m.Map()
   }
-  s += "]"
-  return s
+  return x.(Map)
 }
 
 /******************************************************************************
@@ -1602,6 +4887,7 @@ type Int struct {
 type BV = Int
 
 func intOf(i *big.Int) Int {
+  runtimeStats.bigInts.add(1)
   return Int{
     impl: i,
     // debug: i.String(),
@@ -2038,7 +5324,8 @@ func (i Int) dividesAPowerOf10() (yes bool, factor Int, log10 int) {
 func IntegerRange(lo, hi Int) Iterator {
   if lo.impl != nil {
     i := lo
-    return func() (interface{}, bool) {
+    next := func() (interface{}, bool) {
+      CheckCanceled()
       if hi.impl != nil && i.Cmp(hi) >= 0 {
         return nil, false
       } else {
@@ -2047,18 +5334,41 @@ func IntegerRange(lo, hi Int) Iterator {
         return ans, true
       }
     }
+    if hi.impl != nil {
+      return next
+    }
+    return withBudget("IntegerRange(" + lo.String() + ", _)", next)
   } else if hi.impl != nil {
     i := hi
-    return func() (interface{}, bool) {
+    return withBudget("IntegerRange(_, " + hi.String() + ")", func() (interface{}, bool) {
+      CheckCanceled()
       ans := i
       i = i.Minus(One)
       return ans, true
-    }
+    })
   } else {
     return AllIntegers()
   }
 }
 
+// An IntRange is the range of integers that IntegerRange iterates over, as a
+// value that quantifiers can recognize: a quantifier over an IntRange with both
+// bounds is evaluated by ParallelRangeQuantifier.
+type IntRange struct {
+  Lo, Hi Int
+}
+
+// IntegerRangeOf returns the range of integers from lo up to (but not
+// including) hi, either of which may be missing (nil).
+func IntegerRangeOf(lo, hi Int) IntRange {
+  return IntRange{lo, hi}
+}
+
+// Iterator implements the Iterable interface.
+func (r IntRange) Iterator() Iterator {
+  return IntegerRange(r.Lo, r.Hi)
+}
+
 // AllIntegers returns an iterator over all integers, starting at zero and
 // alternating between positive and negative.
 func AllIntegers() Iterator {
@@ -2072,7 +5382,8 @@ func AllIntegers() Iterator {
   i := Zero
   p := zeroPhase
 
-  return func() (interface{}, bool) {
+  return withBudget("AllIntegers", func() (interface{}, bool) {
+    CheckCanceled()
     switch p {
     case zeroPhase:
       i = One
@@ -2089,7 +5400,7 @@ func AllIntegers() Iterator {
     default:
       panic("unknown phase")
     }
-  }
+  })
 }
 
 /******************************************************************************
@@ -2600,8 +5911,901 @@ func max(n, m int) int {
   }
 }
 
+// CatchHalt reports a halt, if there was one, and flushes the output.  It is
+// meant to be deferred.
 func CatchHalt() {
   if r := recover(); r != nil {
-    fmt.Println("[Program halted]", r)
+    reportHalt(r)
+  }
+  FlushOutput()
+}
+
+func reportHalt(r interface{}) {
+  writeOutput(fmt.Sprintln("[Program halted]", r))
+}
+
+/******************************************************************************
+ * Runtime statistics
+ ******************************************************************************/
+
+// The runtime can keep counters of how it's being used, for observing a
+// program in production.  They're off unless turned on by EnableStats (which
+// the DafnyStats package does when it publishes them), and then cost an atomic
+// addition to one of several shards, which keeps goroutines on different
+// processors from contending for the same cache line.  Read them with
+// ReadStats.
+
+var statsEnabled atomic.Bool
+
+// EnableStats turns the runtime statistics on or off, and returns whether they
+// were on.  Statistics are counted only while they're on.
+func EnableStats(enabled bool) bool {
+  return statsEnabled.Swap(enabled)
+}
+
+// statShards is the number of shards of each counter.
+const statShards = 16
+
+// statShard picks a shard at random, which spreads concurrent updates over
+// the shards without knowing which processor a goroutine runs on.
+func statShard() int {
+  return int(randv2.Uint32() % statShards)
+}
+
+// A counter is an atomic counter sharded over cache lines.
+type counter [statShards]struct {
+  n atomic.Uint64
+  _ [56]byte // pads the shard to a cache line
+}
+
+func (c *counter) add(n uint64) {
+  if statsEnabled.Load() {
+    c[statShard()].n.Add(n)
+  }
+}
+
+func (c *counter) load() uint64 {
+  var total uint64
+  for i := range c {
+    total += c[i].n.Load()
+  }
+  return total
+}
+
+// sizeClasses is the number of buckets in a size histogram: one for empty
+// collections, and one for each range [2^(i-1), 2^i), the last of which takes
+// every size from 2^(sizeClasses-2) on.
+const sizeClasses = 18
+
+// A sizeHistogram is sharded like a counter, a whole histogram per shard.
+type sizeHistogram [statShards]struct {
+  counts [sizeClasses]atomic.Uint64
+  _      [48]byte // pads the shard to a multiple of a cache line
+}
+
+func (h *sizeHistogram) record(n int) {
+  if statsEnabled.Load() {
+    h[statShard()].counts[min(bits.Len(uint(n)), sizeClasses-1)].Add(1)
+  }
+}
+
+func (h *sizeHistogram) read() SizeHistogram {
+  counts := make([]uint64, sizeClasses)
+  for i := range h {
+    for j := range counts {
+      counts[j] += h[i].counts[j].Load()
+    }
+  }
+  return SizeHistogram{counts}
+}
+
+var runtimeStats struct {
+  bigInts                                     counter
+  seqConcats, seqConcatElements               counter
+  deepEqualFallbacks                          counter
+  seqSizes, setSizes, multiSetSizes, mapSizes sizeHistogram
+}
+
+// A SizeHistogram counts collections by size.  Counts[0] is the number of
+// empty collections, and Counts[i] for i > 0 the number with at least 2^(i-1)
+// and fewer than 2^i elements, except that the last bucket has no upper bound.
+type SizeHistogram struct {
+  Counts []uint64
+}
+
+// Total returns the number of collections counted.
+func (h SizeHistogram) Total() uint64 {
+  var total uint64
+  for _, n := range h.Counts {
+    total += n
+  }
+  return total
+}
+
+// Stats are the runtime statistics counted while they were on.
+type Stats struct {
+  // BigInts counts the Ints created by arithmetic and conversions, each of
+  // which allocates a big.Int (constants and small cached values aside)
+  BigInts uint64
+  // SeqConcats counts the concatenations that copied their operands into a
+  // new sequence, and SeqConcatElements the elements they copied
+  SeqConcats, SeqConcatElements uint64
+  // DeepEqualFallbacks counts the comparisons that AreEqual left to
+  // reflect.DeepEqual, for lack of an EqualsGeneric method
+  DeepEqualFallbacks uint64
+  // LiveCoroutines is the number of coroutines (such as those of compiled
+  // iterators) whose goroutines are running, as given by LiveCoroutines
+  LiveCoroutines int64
+  // The sizes of the collections built, with the number of distinct elements
+  // for multisets
+  SeqSizes, SetSizes, MultiSetSizes, MapSizes SizeHistogram
+}
+
+// ReadStats returns the current runtime statistics.
+func ReadStats() Stats {
+  return Stats{
+    BigInts:            runtimeStats.bigInts.load(),
+    SeqConcats:         runtimeStats.seqConcats.load(),
+    SeqConcatElements:  runtimeStats.seqConcatElements.load(),
+    DeepEqualFallbacks: runtimeStats.deepEqualFallbacks.load(),
+    LiveCoroutines:     LiveCoroutines(),
+    SeqSizes:           runtimeStats.seqSizes.read(),
+    SetSizes:           runtimeStats.setSizes.read(),
+    MultiSetSizes:      runtimeStats.multiSetSizes.read(),
+    MapSizes:           runtimeStats.mapSizes.read(),
+  }
+}
+
+/******************************************************************************
+ * Call profiling
+ ******************************************************************************/
+
+// When profiling is enabled, functions and methods compiled with /profileCalls
+// report their calls through ProfileCall, under their Dafny names.  The
+// runtime keeps call counts and times for each name, and labels the goroutine
+// with the name of the Dafny code it's running, so that CPU profiles taken
+// with pprof can be broken down by Dafny function (the label is
+// "dafny.function").  The label is added to
+// the goroutine's own labels, which are restored when the call returns.
+//
+// The calls in progress are kept with the goroutine's state, so calls made by
+// different goroutines don't disturb each other's times.  A call made by a
+// goroutine that another call started counts as nested in that call.
+//
+// Allocations are attributed to Dafny functions from Go's heap profile, by
+// the Go functions on the stacks it samples, so they're estimates, as of the
+// most recent garbage collection.
+//
+// Profiling is off unless turned on by EnableProfiling, or by
+// SetCallProfileFile, which also has EndMain write the report to a file.  It
+// adds some overhead to each call, which inflates the times of short
+// functions.
+
+// CallStats are the statistics of the calls to a Dafny function or method.
+// Time, Allocs and AllocBytes include nested calls, but recursive calls aren't
+// counted twice; SelfTime doesn't include nested calls.
+type CallStats struct {
+  Name               string
+  Calls              uint64
+  Time, SelfTime     time.Duration
+  Allocs, AllocBytes uint64
+}
+
+var profilingEnabled atomic.Bool
+
+// callCounters are the counts behind a CallStats.
+type callCounters struct {
+  calls          atomic.Uint64
+  time, selfTime atomic.Int64
+}
+
+var callStats sync.Map // name -> *callCounters
+
+func countersOf(name string) *callCounters {
+  if c, ok := callStats.Load(name); ok {
+    return c.(*callCounters)
+  }
+  c, _ := callStats.LoadOrStore(name, &callCounters{})
+  return c.(*callCounters)
+}
+
+type profileFrame struct {
+  name      string
+  start     time.Time
+  childTime atomic.Int64  // nested calls can return on other goroutines
+  outermost bool          // no frame it's nested in has the same name
+  parent    *profileFrame // the call this one is nested in, if any
+}
+
+// ProfileCallLabel is the pprof label that holds the name of the Dafny
+// function or method running in a goroutine.
+const ProfileCallLabel = "dafny.function"
+
+// EnableProfiling turns call profiling on or off, and returns whether it was
+// on.  Calls in progress when it's turned on aren't profiled.
+func EnableProfiling(enabled bool) bool {
+  return profilingEnabled.Swap(enabled)
+}
+
+// ProfilingEnabled returns whether call profiling is on.  Code compiled with
+// /profileCalls checks it before calling ProfileCall.
+func ProfilingEnabled() bool {
+  return profilingEnabled.Load()
+}
+
+// ProfileCall records the start of a call to the named Dafny function or
+// method, and returns a function to call when the call returns:
+//
+//   if _dafny.ProfilingEnabled() {
+//     defer _dafny.ProfileCall("Module.Class.Method")()
+//   }
+//
+// Being deferred, the returned function runs even if the call halts.
+// ProfileCall must be called by the Go function that implements the Dafny
+// one, for allocations to be attributed to it.
+func ProfileCall(name string) func() {
+  if _, ok := profiledFuncs.Load(name); !ok {
+    registerProfiledFunc(name)
+  }
+  frame := &profileFrame{name: name, outermost: true}
+  if s := currentState(); s != nil {
+    frame.parent = s.frame
+  }
+  for f := frame.parent; f != nil; f = f.parent {
+    if f.name == name {
+      frame.outermost = false
+      break
+    }
+  }
+  exit := enterState(pprof.Labels(ProfileCallLabel, name), func(s *goroutineState) {
+    s.frame = frame
+  })
+  frame.start = time.Now()
+
+  return func() {
+    elapsed := time.Since(frame.start)
+    exit()
+    if frame.parent != nil {
+      frame.parent.childTime.Add(int64(elapsed))
+    }
+    counters := countersOf(name)
+    counters.calls.Add(1)
+    // Calls by goroutines that this one started can take longer than it does
+    if self := int64(elapsed) - frame.childTime.Load(); self > 0 {
+      counters.selfTime.Add(self)
+    }
+    if frame.outermost {
+      counters.time.Add(int64(elapsed))
+    }
+  }
+}
+
+var profiledFuncs sync.Map // Dafny name -> Go function name
+
+var allocMu sync.Mutex
+var goFuncs = make(map[string]string)            // Go function name -> Dafny name, or "" if several
+var allocBaseline = make(map[[32]uintptr][2]int64) // heap profile record -> objects and bytes at reset
+
+// registerProfiledFunc maps the Go function calling ProfileCall to the named
+// Dafny function.  A Go function that reports calls under several names can't
+// have its allocations attributed.
+func registerProfiledFunc(name string) {
+  pcs := make([]uintptr, 1)
+  runtime.Callers(3, pcs)
+  frame, _ := runtime.CallersFrames(pcs).Next()
+  allocMu.Lock()
+  defer allocMu.Unlock()
+  if other, ok := goFuncs[frame.Function]; ok && other != name {
+    goFuncs[frame.Function] = ""
+  } else {
+    goFuncs[frame.Function] = name
+  }
+  profiledFuncs.Store(name, frame.Function)
+}
+
+// heapProfile returns the records of Go's heap profile.
+func heapProfile() []runtime.MemProfileRecord {
+  n, _ := runtime.MemProfile(nil, true)
+  for {
+    records := make([]runtime.MemProfileRecord, n+50)
+    n, ok := runtime.MemProfile(records, true)
+    if ok {
+      return records[:n]
+    }
+  }
+}
+
+// callAllocs estimates the allocations made by each profiled Dafny function
+// since the profile was reset, scaling the heap profile's samples up the way
+// pprof does.
+func callAllocs() map[string][2]uint64 {
+  allocMu.Lock()
+  defer allocMu.Unlock()
+  allocs := make(map[string][2]uint64)
+  rate := float64(runtime.MemProfileRate)
+  for _, r := range heapProfile() {
+    base := allocBaseline[r.Stack0]
+    objects, bytes := r.AllocObjects-base[0], r.AllocBytes-base[1]
+    if objects <= 0 || bytes <= 0 {
+      continue
+    }
+    scale := 1.0
+    if rate > 1 {
+      scale = 1 / (1 - math.Exp(-float64(bytes)/float64(objects)/rate))
+    }
+    names := make(map[string]bool) // recursive calls count once
+    frames := runtime.CallersFrames(r.Stack())
+    for more := true; more; {
+      var frame runtime.Frame
+      frame, more = frames.Next()
+      if name := goFuncs[frame.Function]; name != "" && !names[name] {
+        names[name] = true
+        a := allocs[name]
+        allocs[name] = [2]uint64{a[0] + uint64(float64(objects)*scale), a[1] + uint64(float64(bytes)*scale)}
+      }
+    }
+  }
+  return allocs
+}
+
+// CallProfile returns the statistics gathered so far, hottest (by Time) first.
+func CallProfile() []CallStats {
+  allocs := callAllocs()
+  var profile []CallStats
+  callStats.Range(func(name, c interface{}) bool {
+    counters := c.(*callCounters)
+    a := allocs[name.(string)]
+    profile = append(profile, CallStats{
+      Name:       name.(string),
+      Calls:      counters.calls.Load(),
+      Time:       time.Duration(counters.time.Load()),
+      SelfTime:   time.Duration(counters.selfTime.Load()),
+      Allocs:     a[0],
+      AllocBytes: a[1],
+    })
+    return true
+  })
+  sort.Slice(profile, func(i, j int) bool {
+    if profile[i].Time != profile[j].Time {
+      return profile[i].Time > profile[j].Time
+    }
+    return profile[i].Name < profile[j].Name
+  })
+  return profile
+}
+
+// ResetCallProfile discards the statistics gathered so far.
+func ResetCallProfile() {
+  callStats.Clear()
+  allocMu.Lock()
+  defer allocMu.Unlock()
+  clear(allocBaseline)
+  for _, r := range heapProfile() {
+    allocBaseline[r.Stack0] = [2]int64{r.AllocObjects, r.AllocBytes}
+  }
+}
+
+// WriteCallProfile writes the statistics gathered so far as a table.
+func WriteCallProfile(w io.Writer) error {
+  tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+  fmt.Fprintln(tw, "calls\ttime\tself time\tallocs\talloc bytes\tname")
+  for _, stats := range CallProfile() {
+    fmt.Fprintf(tw, "%d\t%v\t%v\t%d\t%d\t%s\n", stats.Calls, stats.Time, stats.SelfTime, stats.Allocs, stats.AllocBytes, stats.Name)
+  }
+  return tw.Flush()
+}
+
+var callProfileFile atomic.Pointer[string]
+
+// SetCallProfileFile turns call profiling on, and has EndMain write the report
+// to the named file when the program ends.  An extern called at the start of
+// Main can use it to profile a whole program.
+func SetCallProfileFile(path string) {
+  callProfileFile.Store(&path)
+  EnableProfiling(true)
+}
+
+// writeCallProfileFile writes the report requested through SetCallProfileFile,
+// if any.
+func writeCallProfileFile() {
+  path := callProfileFile.Load()
+  if path == nil {
+    return
+  }
+  file, err := os.Create(*path)
+  if err == nil {
+    err = WriteCallProfile(file)
+    if closeErr := file.Close(); err == nil {
+      err = closeErr
+    }
+  }
+  if err != nil {
+    fmt.Fprintf(os.Stderr, "call profile: %v\n", err)
+  }
+}
+
+/******************************************************************************
+ * Random generation
+ ******************************************************************************/
+
+// SeqTypeOf returns the RTD of sequences with the given element type.  Unlike
+// SeqType, it carries the element type, which the Generator needs; the same
+// goes for the other collection RTDs below.
+func SeqTypeOf(elemType TypeDescriptor) TypeDescriptor {
+  return seqType{elemType}
+}
+
+type seqType struct {
+  elemType TypeDescriptor
+}
+
+func (st seqType) Default() interface{} {
+  return EmptySeq.WithElementType(st.elemType)
+}
+
+func (st seqType) String() string {
+  return "seq<" + String(st.elemType) + ">"
+}
+
+// SetTypeOf returns the RTD of sets with the given element type.
+func SetTypeOf(elemType TypeDescriptor) TypeDescriptor {
+  return setType{elemType}
+}
+
+type setType struct {
+  elemType TypeDescriptor
+}
+
+func (st setType) Default() interface{} {
+  return EmptySet
+}
+
+func (st setType) String() string {
+  return "set<" + String(st.elemType) + ">"
+}
+
+// MultiSetTypeOf returns the RTD of multisets with the given element type.
+func MultiSetTypeOf(elemType TypeDescriptor) TypeDescriptor {
+  return multiSetType{elemType}
+}
+
+type multiSetType struct {
+  elemType TypeDescriptor
+}
+
+func (mt multiSetType) Default() interface{} {
+  return EmptyMultiSet
+}
+
+func (mt multiSetType) String() string {
+  return "multiset<" + String(mt.elemType) + ">"
+}
+
+// MapTypeOf returns the RTD of maps with the given key and value types.
+func MapTypeOf(keyType, valueType TypeDescriptor) TypeDescriptor {
+  return mapType{keyType, valueType}
+}
+
+type mapType struct {
+  keyType, valueType TypeDescriptor
+}
+
+func (mt mapType) Default() interface{} {
+  return EmptyMap
+}
+
+func (mt mapType) String() string {
+  return "map<" + String(mt.keyType) + ", " + String(mt.valueType) + ">"
+}
+
+// An Arbitrary RTD knows how to generate values of its type, which is how
+// values of user-defined types (datatypes, say) can be generated.  The values
+// should be derived only from the choices made through g, so that they can be
+// replayed and shrunk.
+type Arbitrary interface {
+  TypeDescriptor
+  Generate(g *Generator) interface{}
+}
+
+// A Generator produces arbitrary values of a type, given its RTD.  Every value
+// is derived from a sequence of choices, one byte at a time, which come either
+// from a pseudo-random generator or from a given byte string (such as an input
+// of a Go fuzz corpus).  The choices are recorded, so that a value can be
+// reproduced from them.
+//
+// Simpler values come from smaller choices: once the given bytes run out, every
+// choice is zero, which produces zero, false, 'a' and empty collections.  A
+// failing input is thus shrunk by shrinking its choices; see Shrink.
+//
+// A Generator isn't safe for concurrent use.
+type Generator struct {
+  // MaxSize bounds the number of elements of collections, the lengths of
+  // array dimensions, and the magnitude of most integers
+  MaxSize int
+
+  rng       *rand.Rand
+  data      []byte
+  pos       int
+  recorded  []byte
+  depth     int
+  generated []interface{}
+}
+
+// DefaultMaxSize is the MaxSize of new Generators.
+const DefaultMaxSize = 8
+
+// NewGenerator returns a Generator whose choices are pseudo-random, determined
+// by the given seed.
+func NewGenerator(seed int64) *Generator {
+  return &Generator{MaxSize: DefaultMaxSize, rng: rand.New(rand.NewSource(seed))}
+}
+
+// NewGeneratorFromBytes returns a Generator whose choices are the given bytes,
+// followed by zeros.
+func NewGeneratorFromBytes(data []byte) *Generator {
+  return &Generator{MaxSize: DefaultMaxSize, data: data}
+}
+
+// Bytes returns the choices made so far.  A Generator created from them by
+// NewGeneratorFromBytes makes the same choices, and thus produces the same
+// values.
+func (g *Generator) Bytes() []byte {
+  return append([]byte(nil), g.recorded...)
+}
+
+// Generated returns the values produced so far by Generate (excluding the
+// components of those values).
+func (g *Generator) Generated() []interface{} {
+  return append([]interface{}(nil), g.generated...)
+}
+
+// Byte makes a choice.
+func (g *Generator) Byte() byte {
+  var b byte
+  switch {
+  case g.pos < len(g.data):
+    b = g.data[g.pos]
+  case g.rng != nil:
+    b = byte(g.rng.Intn(256))
+  }
+  g.pos++
+  g.recorded = append(g.recorded, b)
+  return b
+}
+
+// Uint64 makes a choice of n bytes, most significant first.
+func (g *Generator) Uint64(n int) uint64 {
+  var u uint64
+  for i := 0; i < n; i++ {
+    u = u<<8 | uint64(g.Byte())
+  }
+  return u
+}
+
+// Bool chooses a bool.
+func (g *Generator) Bool() bool {
+  return g.Byte()&1 == 1
+}
+
+// IntN chooses an int in [0, n).  It panics if n <= 0.
+func (g *Generator) IntN(n int) int {
+  if n <= 0 {
+    panic("Generator.IntN: n must be positive")
+  }
+  width := 1
+  for uint64(n-1)>>(8*width) != 0 {
+    width++
+  }
+  return int(g.Uint64(width) % uint64(n))
+}
+
+// more decides whether to add another element to a collection of n elements.
+// The decisions are made one element at a time, so that deleting the choices
+// of an element when shrinking leaves the choices of the others as they were.
+func (g *Generator) more(n int) bool {
+  if n >= g.MaxSize {
+    return false
+  }
+  // A zero byte stops; on average, about MaxSize / 2 elements are added
+  return int(g.Byte()) >= 256/(g.MaxSize/2+2)
+}
+
+// Generate produces a value of the type described by rtd.  Besides the RTDs
+// of built-in types, it supports TupleType, the RTDs returned by SeqTypeOf and
+// its relatives (which compiled code uses for sequence, set, multiset and map
+// types whose element types have RTDs), and Arbitrary RTDs; for any other RTD,
+// it produces the default value.
+func (g *Generator) Generate(rtd TypeDescriptor) interface{} {
+  g.depth++
+  value := g.generate(rtd)
+  g.depth--
+  if g.depth == 0 {
+    g.generated = append(g.generated, value)
+  }
+  return value
+}
+
+func (g *Generator) generate(rtd TypeDescriptor) interface{} {
+  CheckCanceled()
+  switch rtd := rtd.(type) {
+  case Arbitrary:
+    return rtd.Generate(g)
+  case seqType:
+    var values []interface{}
+    for g.more(len(values)) {
+      values = append(values, g.Generate(rtd.elemType))
+    }
+    return SeqOf(values...).WithElementType(rtd.elemType)
+  case setType:
+    var values []interface{}
+    for g.more(len(values)) {
+      values = append(values, g.Generate(rtd.elemType))
+    }
+    return SetOf(values...)
+  case multiSetType:
+    var values []interface{}
+    for g.more(len(values)) {
+      values = append(values, g.Generate(rtd.elemType))
+    }
+    return MultiSetOf(values...)
+  case mapType:
+    mb := NewMapBuilder()
+    for g.more(mb.Len()) {
+      mb.Add(g.Generate(rtd.keyType), g.Generate(rtd.valueType))
+    }
+    return mb.ToMap()
+  case tupleType:
+    values := make([]interface{}, len(rtd.eltTys))
+    for i, ty := range rtd.eltTys {
+      values[i] = g.Generate(ty)
+    }
+    return TupleOf(values...)
+  }
+
+  switch rtd {
+  case IntType:
+    return g.generateInt()
+  case BoolType:
+    return g.Bool()
+  case CharType:
+    return g.generateChar()
+  case RealType:
+    return RealOfFrac(g.generateInt(), IntOf(1+g.IntN(g.MaxSize)))
+  case Int8Type:
+    return int8(g.Uint64(1))
+  case Int16Type:
+    return int16(g.Uint64(2))
+  case Int32Type:
+    return int32(g.Uint64(4))
+  case Int64Type:
+    return int64(g.Uint64(8))
+  case Uint8Type:
+    return uint8(g.Uint64(1))
+  case Uint16Type:
+    return uint16(g.Uint64(2))
+  case Uint32Type:
+    return uint32(g.Uint64(4))
+  case Uint64Type:
+    return g.Uint64(8)
+  }
+  return rtd.Default()
+}
+
+// generateInt mostly chooses small integers, within MaxSize of zero, and
+// sometimes ones of up to 16 bytes.
+func (g *Generator) generateInt() Int {
+  var i Int
+  if g.IntN(8) < 6 {
+    i = IntOf(g.IntN(g.MaxSize + 1))
+  } else {
+    n := 1 + g.IntN(16)
+    buf := make([]byte, n)
+    for j := range buf {
+      buf[j] = g.Byte()
+    }
+    i = intOf(new(big.Int).SetBytes(buf))
+  }
+  if g.Bool() {
+    i = i.Negated()
+  }
+  return i
+}
+
+const generatedChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// generateChar mostly chooses printable ASCII characters, and sometimes any
+// character of the Basic Multilingual Plane other than a surrogate.
+func (g *Generator) generateChar() Char {
+  if g.IntN(4) < 3 {
+    return Char(generatedChars[g.IntN(len(generatedChars))])
+  }
+  c := rune(g.Uint64(2))
+  if 0xD800 <= c && c < 0xE000 {
+    c -= 0xD800
+  }
+  return Char(c)
+}
+
+// A Property is a predicate over values drawn from a Generator.  It fails by
+// returning false or by halting (a failed expect statement, say).
+type Property func(g *Generator) bool
+
+// Fails runs the property on the values produced from the given choices, and
+// returns whether it fails, along with the values and the choices it actually
+// used.
+func (prop Property) Fails(data []byte) (failed bool, values []interface{}, used []byte) {
+  g := NewGeneratorFromBytes(data)
+  return prop.FailsOn(g), g.Generated(), g.Bytes()
+}
+
+// FailsOn runs the property on the values produced by g, and returns whether
+// it fails.  The choices it made can then be had from g.Bytes.  The property
+// runs in a Call with the caller's context, so that it halts on its own, and
+// its output is discarded; if the context is done, FailsOn raises a
+// CancellationHalt rather than report a failure.
+func (prop Property) FailsOn(g *Generator) bool {
+  holds := false
+  err := Call(Context(), func() {
+    RedirectOutput(io.Discard, func() {
+      holds = prop(g)
+    })
+  })
+  if _, halted := err.(*HaltError); err != nil && !halted {
+    panic(CancellationHalt{err})
+  }
+  return err != nil || !holds
+}
+
+// Shrink looks for a smaller sequence of choices on which the property still
+// fails, given one on which it fails.  It tries deleting and zeroing runs of
+// choices and making single choices smaller, as long as that keeps failing.
+// Smaller choices produce simpler values, so the result is a simpler
+// counterexample.
+func (prop Property) Shrink(data []byte) []byte {
+  _, _, best := prop.Fails(data)
+  try := func(candidate []byte) bool {
+    if failed, _, used := prop.Fails(candidate); failed && shortlex(used, best) {
+      best = used
+      return true
+    }
+    return false
+  }
+  for improved := true; improved; {
+    improved = false
+    for size := 8; size >= 1; size /= 2 {
+      for i := 0; i+size <= len(best); {
+        candidate := append(append([]byte(nil), best[:i]...), best[i+size:]...)
+        if try(candidate) {
+          improved = true
+        } else {
+          i++
+        }
+      }
+    }
+    for size := 8; size >= 1; size /= 2 {
+      for i := 0; i+size <= len(best); i++ {
+        candidate := append([]byte(nil), best...)
+        clear(candidate[i : i+size])
+        improved = try(candidate) || improved
+      }
+    }
+    for i := 0; i < len(best); i++ {
+      // Binary search for the smallest value of this byte that still fails
+      lo, hi := 0, int(best[i])
+      for lo < hi && i < len(best) {
+        mid := (lo + hi) / 2
+        candidate := append([]byte(nil), best...)
+        candidate[i] = byte(mid)
+        if try(candidate) {
+          improved = true
+          hi = mid
+        } else {
+          lo = mid + 1
+        }
+      }
+    }
+  }
+  return best
+}
+
+// shortlex says whether a is shorter than b, or else is the same length and
+// lexicographically smaller.
+func shortlex(a, b []byte) bool {
+  if len(a) != len(b) {
+    return len(a) < len(b)
+  }
+  return bytes.Compare(a, b) < 0
+}
+
+/******************************************************************************
+ * Testing
+ ******************************************************************************/
+
+// A TestCase is a compiled {:test} method.  Run returns nil if the test
+// passes, or else the failure value that the method returned; a halt, such as
+// a failed expect statement, fails the test too.
+type TestCase struct {
+  Name string
+  Run  func() interface{}
+}
+
+var testsMu sync.Mutex
+var registeredTests []TestCase
+
+// RegisterTest registers a {:test} method under its Dafny name.  Compiled
+// modules register their tests as they're initialized, and the DafnyTesting
+// package runs them under "go test".
+func RegisterTest(name string, run func() interface{}) {
+  testsMu.Lock()
+  defer testsMu.Unlock()
+  registeredTests = append(registeredTests, TestCase{name, run})
+}
+
+// RegisteredTests returns the registered tests, in the order of registration.
+func RegisteredTests() []TestCase {
+  testsMu.Lock()
+  defer testsMu.Unlock()
+  return append([]TestCase(nil), registeredTests...)
+}
+
+/******************************************************************************
+ * Program entry
+ ******************************************************************************/
+
+var exitCode atomic.Int32
+var haltExitCode atomic.Int32
+
+// SetExitCode sets the exit code with which the program will exit if its main
+// method returns normally.
+func SetExitCode(code int) {
+  exitCode.Store(int32(code))
+}
+
+// SetHaltExitCode sets the exit code with which the program will exit if it
+// halts.  It's 0 unless set, as it always has been, so that a program's exit
+// code doesn't change with the runtime; call SetHaltExitCode(1) from an extern
+// to have a halt reported as a failure instead.
+func SetHaltExitCode(code int) {
+  haltExitCode.Store(int32(code))
+}
+
+// mainExitCode returns the code that the program exits with.
+func mainExitCode(halted bool) int {
+  if halted {
+    return int(haltExitCode.Load())
+  }
+  return int(exitCode.Load())
+}
+
+// FromMainArguments converts the arguments to a Go program into the
+// sequence of strings taken by a Dafny main method.  As with os.Args, the
+// first element is the program's name.
+func FromMainArguments(args []string) Seq {
+  strs := make([]interface{}, len(args))
+  for i, arg := range args {
+    strs[i] = SeqOfString(arg)
+  }
+  return Seq{strs, SeqType}
+}
+
+// MainArguments returns the arguments to the running program, for passing to
+// a Dafny main method.
+func MainArguments() Seq {
+  return FromMainArguments(os.Args)
+}
+
+// EndMain is deferred by a compiled program's main function.  Like CatchHalt,
+// it reports a halt and flushes the output, and then it ends the program with
+// the code set by SetHaltExitCode after a halt or otherwise with the code set
+// by SetExitCode.
+func EndMain() {
+  r := recover()
+  if r != nil {
+    reportHalt(r)
+  }
+  FlushOutput()
+  writeCallProfileFile()
+  if code := mainExitCode(r != nil); code != 0 {
+    os.Exit(code)
   }
 }
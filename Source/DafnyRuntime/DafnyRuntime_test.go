@@ -0,0 +1,1845 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+// Unit tests of the Go runtime; run them with test-go.sh.
+
+package dafny
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "io"
+  "iter"
+  "math/rand"
+  "runtime"
+  "runtime/pprof"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// collect gathers the values of an iterator.
+func collect(it Iterator) []interface{} {
+  var values []interface{}
+  for v, ok := it(); ok; v, ok = it() {
+    values = append(values, v)
+  }
+  return values
+}
+
+// naturals is an infinite iter.Seq that records whether it has been released.
+func naturals(released *atomic.Bool) iter.Seq[interface{}] {
+  return func(yield func(interface{}) bool) {
+    defer released.Store(true)
+    for i := 0; ; i++ {
+      if !yield(IntOf(i)) {
+        return
+      }
+    }
+  }
+}
+
+// eventually waits for a condition that depends on the garbage collector.
+func eventually(t *testing.T, cond func() bool) {
+  t.Helper()
+  for i := 0; i < 100; i++ {
+    if cond() {
+      return
+    }
+    runtime.GC()
+    time.Sleep(time.Millisecond)
+  }
+  t.Fatal("condition never became true")
+}
+
+/******************************************************************************
+ * Iteration
+ ******************************************************************************/
+
+func TestIterSeqRoundTrip(t *testing.T) {
+  s := SeqOf(One, Two, Five)
+  var ranged []interface{}
+  for v := range All(s) {
+    ranged = append(ranged, v)
+  }
+  if got := SeqOf(ranged...); !got.Equals(s) {
+    t.Errorf("ranging over All(%v) gave %v", s, got)
+  }
+  if got := SeqOf(collect(FromIterSeq(ToIterSeq(s.Iterator())))...); !got.Equals(s) {
+    t.Errorf("FromIterSeq(ToIterSeq(%v)) gave %v", s, got)
+  }
+  if got := SeqOf(collect(Iterate(All(s)))...); !got.Equals(s) {
+    t.Errorf("Iterate(All(%v)) gave %v", s, got)
+  }
+}
+
+func TestPullIterSeqStop(t *testing.T) {
+  var released atomic.Bool
+  it, stop := PullIterSeq(naturals(&released))
+  if v, ok := it(); !ok || !AreEqual(v, Zero) {
+    t.Fatalf("first value is %v, %v", v, ok)
+  }
+  stop()
+  if !released.Load() {
+    t.Error("stop didn't release the sequence")
+  }
+  if _, ok := it(); ok {
+    t.Error("iterator yields values after stop")
+  }
+  stop()
+}
+
+func TestQuantifierReleasesIterSeq(t *testing.T) {
+  var released atomic.Bool
+  holds := QuantifierOf(naturals(&released), false, func(i Int) bool {
+    return i.Cmp(Ten) == 0
+  })
+  if !holds {
+    t.Error("exists i :: i == 10 doesn't hold")
+  }
+  if !released.Load() {
+    t.Error("quantifier didn't release the sequence it short-circuited")
+  }
+}
+
+func TestAbandonedFromIterSeqIsReleased(t *testing.T) {
+  var released atomic.Bool
+  func() {
+    it := FromIterSeq(naturals(&released))
+    it()
+  }()
+  eventually(t, func() bool { return released.Load() })
+}
+
+/******************************************************************************
+ * Coroutines
+ ******************************************************************************/
+
+func countTo(n int, out *[]int) func(yield func() bool) {
+  return func(yield func() bool) {
+    for i := 0; i < n; i++ {
+      *out = append(*out, i)
+      if !yield() {
+        return
+      }
+    }
+  }
+}
+
+func TestCoroutineRunsToCompletion(t *testing.T) {
+  var out []int
+  co := NewCoroutine(countTo(3, &out))
+  live := LiveCoroutines()
+  resumes := 0
+  for co.Resume() {
+    resumes++
+    if len(out) != resumes {
+      t.Fatalf("body ran to %v after %d resumes", out, resumes)
+    }
+  }
+  if resumes != 3 {
+    t.Errorf("Resume returned true %d times, want 3", resumes)
+  }
+  if co.Resume() {
+    t.Error("Resume returned true after the body returned")
+  }
+  if n := LiveCoroutines(); n != live {
+    t.Errorf("LiveCoroutines() = %d after the body returned, want %d", n, live)
+  }
+}
+
+func TestCoroutineClose(t *testing.T) {
+  var out []int
+  live := LiveCoroutines()
+  co := NewCoroutine(countTo(10, &out))
+  co.Resume()
+  if n := LiveCoroutines(); n != live+1 {
+    t.Errorf("LiveCoroutines() = %d while suspended, want %d", n, live+1)
+  }
+  co.Close()
+  co.Close()
+  if n := LiveCoroutines(); n != live {
+    t.Errorf("LiveCoroutines() = %d after Close, want %d", n, live)
+  }
+  if co.Resume() || len(out) != 1 {
+    t.Errorf("body ran to %v after Close, want [0]", out)
+  }
+
+  // Closing a coroutine that never started doesn't start it
+  NewCoroutine(func(func() bool) { t.Error("closed coroutine ran") }).Close()
+}
+
+func TestCoroutinePanic(t *testing.T) {
+  co := NewCoroutine(func(yield func() bool) {
+    yield()
+    panic("oops")
+  })
+  co.Resume()
+  if _, r := halts(func() { co.Resume() }); r != "oops" {
+    t.Errorf("Resume panicked with %v, want \"oops\"", r)
+  }
+  if co.Resume() {
+    t.Error("Resume returned true after the body panicked")
+  }
+}
+
+func TestLiveCoroutineStacks(t *testing.T) {
+  TrackCoroutines(true)
+  defer TrackCoroutines(false)
+  var out []int
+  co := NewCoroutine(countTo(10, &out))
+  co.Resume()
+  if stacks := LiveCoroutineStacks(); len(stacks) == 0 || !strings.Contains(strings.Join(stacks, ""), "TestLiveCoroutineStacks") {
+    t.Errorf("LiveCoroutineStacks() = %q, want the stack of this test", stacks)
+  }
+  co.Close()
+  if stacks := LiveCoroutineStacks(); len(stacks) != 0 {
+    t.Errorf("LiveCoroutineStacks() = %q after Close, want none", stacks)
+  }
+}
+
+/******************************************************************************
+ * Quantifiers
+ ******************************************************************************/
+
+type smallInt int
+
+func TestQuantifierPredicateTypes(t *testing.T) {
+  ints := SeqOf(One, Two, Five)
+  tests := []struct {
+    name     string
+    iter     interface{}
+    isForAll bool
+    pred     interface{}
+    want     bool
+  }{
+    {"untyped forall", ints, true, func(v interface{}) bool { return v.(Int).Sign() > 0 }, true},
+    {"Int forall", ints, true, func(i Int) bool { return i.Cmp(Two) < 0 }, false},
+    {"Int exists", ints, false, func(i Int) bool { return i.Cmp(Five) == 0 }, true},
+    {"bool exists", SeqOf(false, false), false, func(b bool) bool { return b }, false},
+    {"Char forall", SeqOfString("abc"), true, func(c Char) bool { return 'a' <= c && c <= 'z' }, true},
+    {"Seq exists", SeqOf(SeqOf(), SeqOf(One)), false, func(s Seq) bool { return s.CardinalityInt() == 1 }, true},
+    {"reflective forall", SeqOf(smallInt(1), smallInt(3)), true, func(i smallInt) bool { return i%2 == 1 }, true},
+    {"reflective exists", SeqOf(smallInt(1), smallInt(3)), false, func(i smallInt) bool { return i == 2 }, false},
+    {"empty forall", SeqOf(), true, func(i Int) bool { return false }, true},
+    {"empty exists", SeqOf(), false, func(i Int) bool { return true }, false},
+  }
+  for _, test := range tests {
+    if got := Quantifier(test.iter, test.isForAll, test.pred); got != test.want {
+      t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+    }
+  }
+}
+
+func TestQuantifierOfPassesNilAsZero(t *testing.T) {
+  var seen []bool
+  QuantifierOf(SeqOf(nil, true), true, func(b bool) bool {
+    seen = append(seen, b)
+    return true
+  })
+  if len(seen) != 2 || seen[0] || !seen[1] {
+    t.Errorf("QuantifierOf passed %v", seen)
+  }
+}
+
+func TestQuantifierSeq(t *testing.T) {
+  seq := func(yield func(int) bool) {
+    for i := 0; i < 5 && yield(i); i++ {
+    }
+  }
+  if !QuantifierSeq(seq, true, func(i int) bool { return i < 5 }) {
+    t.Error("forall i :: i < 5 doesn't hold")
+  }
+  if QuantifierSeq(seq, false, func(i int) bool { return i == 5 }) {
+    t.Error("exists i :: i == 5 holds")
+  }
+}
+
+/******************************************************************************
+ * Parallel evaluation
+ ******************************************************************************/
+
+// withParallelism runs f with parallel evaluation on, in small chunks.
+func withParallelism(t *testing.T, workers int, f func()) {
+  t.Helper()
+  oldWorkers := SetParallelism(workers)
+  oldChunkSize := SetParallelChunkSize(16)
+  defer func() {
+    SetParallelism(oldWorkers)
+    SetParallelChunkSize(oldChunkSize)
+  }()
+  f()
+}
+
+func TestParallelRangeQuantifier(t *testing.T) {
+  withParallelism(t, 4, func() {
+    n := IntOf(1000)
+    // The quantifier over IntegerRangeOf is how the compiler emits forall i | 0 <= i < n
+    holds := QuantifierOf(IntegerRangeOf(Zero, n), true, func(i Int) bool {
+      return i.Cmp(n) < 0
+    })
+    if !holds {
+      t.Error("forall i | 0 <= i < 1000 :: i < 1000 doesn't hold")
+    }
+    var firstFailure atomic.Int64
+    firstFailure.Store(-1)
+    holds = ParallelRangeQuantifier(Zero, n, true, func(i Int) bool {
+      if i.Cmp(IntOf(500)) >= 0 {
+        firstFailure.CompareAndSwap(-1, i.Int64())
+        return false
+      }
+      return true
+    })
+    if holds || firstFailure.Load() < 500 {
+      t.Errorf("forall i :: i < 500 gave %v, failing at %d", holds, firstFailure.Load())
+    }
+  })
+}
+
+func TestParallelismIsOutermostOnly(t *testing.T) {
+  withParallelism(t, 4, func() {
+    var nestedWorkers atomic.Int32
+    QuantifierOf(IntegerRangeOf(Zero, IntOf(100)), true, func(i Int) bool {
+      workers, done := parallelWorkers()
+      defer done()
+      if workers > 1 {
+        nestedWorkers.Add(1)
+      }
+      return true
+    })
+    if n := nestedWorkers.Load(); n != 0 {
+      t.Errorf("%d nested quantifiers were evaluated in parallel", n)
+    }
+    if workers, done := parallelWorkers(); workers != 4 {
+      t.Errorf("after the quantifier, %d workers are available", workers)
+    } else {
+      done()
+    }
+  })
+}
+
+func TestParallelQuantifierReraisesFirstHalt(t *testing.T) {
+  withParallelism(t, 4, func() {
+    defer func() {
+      if r := recover(); r != "halt at 100" {
+        t.Errorf("recovered %v", r)
+      }
+    }()
+    QuantifierOf(IntegerRangeOf(Zero, IntOf(1000)), true, func(i Int) bool {
+      if i.Cmp(IntOf(100)) >= 0 {
+        panic("halt at " + i.String())
+      }
+      return true
+    })
+  })
+}
+
+// buildSquares builds set i | 0 <= i < n :: i * i the way compiled code does.
+func buildSquares(n int) Set {
+  _coll := NewBuilder()
+  _coll = ParallelBuild(IntegerRangeOf(Zero, IntOf(n)), func(_compr_0 interface{}, _coll *Builder) {
+    i := _compr_0.(Int)
+    _coll.Add(i.Times(i))
+  })
+  return _coll.ToSet()
+}
+
+// buildSquareMap builds map i | 0 <= i < n :: i * i the way compiled code does.
+func buildSquareMap(n int) Map {
+  _coll := NewStrictMapBuilder()
+  _coll = ParallelMapBuild(IntegerRangeOf(Zero, IntOf(n)), func(_compr_0 interface{}, _coll *MapBuilder) {
+    i := _compr_0.(Int)
+    _coll.Add(i, i.Times(i))
+  })
+  return _coll.ToMap()
+}
+
+func TestParallelBuild(t *testing.T) {
+  const n = 500
+  sequentialSet, sequentialMap := buildSquares(n), buildSquareMap(n)
+  if sequentialSet.CardinalityInt() != n || sequentialMap.CardinalityInt() != n {
+    t.Fatalf("sequential builds have %d and %d elements", sequentialSet.CardinalityInt(), sequentialMap.CardinalityInt())
+  }
+  withParallelism(t, 4, func() {
+    if s := buildSquares(n); !s.Equals(sequentialSet) {
+      t.Errorf("parallel set comprehension gave %v", s)
+    }
+    if m := buildSquareMap(n); !m.Equals(sequentialMap) {
+      t.Errorf("parallel map comprehension gave %v", m)
+    }
+  })
+}
+
+/******************************************************************************
+ * Enumeration budgets
+ ******************************************************************************/
+
+// withEnumerationBudget runs f under an enumeration budget.
+func withEnumerationBudget(budget EnumerationBudget, f func()) {
+  old := SetEnumerationBudget(budget)
+  defer SetEnumerationBudget(old)
+  f()
+}
+
+// pull calls an iterator up to n times, and returns how many values it
+// yielded along with the halt, if any.
+func pull(it Iterator, n int) (count int, halt interface{}) {
+  defer func() {
+    halt = recover()
+  }()
+  for ; count < n; count++ {
+    if _, ok := it(); !ok {
+      break
+    }
+  }
+  return count, nil
+}
+
+func TestEnumerationFuel(t *testing.T) {
+  withEnumerationBudget(EnumerationBudget{Fuel: 10}, func() {
+    if count, halt := pull(AllIntegers(), 100); count != 10 || halt == nil {
+      t.Errorf("AllIntegers with 10 fuel yielded %d values, then %v", count, halt)
+    }
+    if count, halt := pull(IntegerRange(Zero, NilInt), 100); count != 10 || halt == nil {
+      t.Errorf("IntegerRange(0, _) with 10 fuel yielded %d values, then %v", count, halt)
+    }
+    if count, halt := pull(IntegerRange(Zero, IntOf(50)), 100); count != 50 || halt != nil {
+      t.Errorf("IntegerRange(0, 50) with 10 fuel yielded %d values, then %v", count, halt)
+    }
+  })
+  if count, halt := pull(AllIntegers(), 100); count != 100 || halt != nil {
+    t.Errorf("AllIntegers without a budget yielded %d values, then %v", count, halt)
+  }
+}
+
+func TestEnumerationTimeout(t *testing.T) {
+  withEnumerationBudget(EnumerationBudget{Timeout: time.Nanosecond}, func() {
+    it := AllIntegers()
+    time.Sleep(time.Millisecond)
+    if count, halt := pull(it, 1_000_000); count >= 1_000_000 || halt == nil {
+      t.Errorf("AllIntegers with a timeout yielded %d values, then %v", count, halt)
+    }
+  })
+}
+
+/******************************************************************************
+ * Choice strategies
+ ******************************************************************************/
+
+// withChoiceStrategy runs f under a choice strategy.
+func withChoiceStrategy(strategy ChoiceStrategy, f func()) {
+  old := SetChoiceStrategy(strategy)
+  defer SetChoiceStrategy(old)
+  f()
+}
+
+// pickPair runs x, y :| x in {0, 1, 2} && y in {0, 1, 2} && x != 0 the way
+// compiled code does.
+func pickPair() (x, y Int) {
+  site := EnterChoice("pair")
+  for _iter0 := site.Choices(0, SeqOf(Zero, One, Two)); ; {
+    _x, _ok := _iter0()
+    if !_ok {
+      break
+    }
+    for _iter1 := site.Choices(1, SeqOf(Zero, One, Two)); ; {
+      _y, _ok := _iter1()
+      if !_ok {
+        break
+      }
+      if _x.(Int).Sign() != 0 {
+        return _x.(Int), _y.(Int)
+      }
+    }
+  }
+  panic("assign-such-that search produced no value")
+}
+
+func TestExhaustiveChoiceNestedVariables(t *testing.T) {
+  ec := NewExhaustiveChoice(3)
+  picks := make(map[string]bool)
+  runs := 0
+  withChoiceStrategy(ec, func() {
+    for more := true; more; more = ec.Next() {
+      runs++
+      x, y := pickPair()
+      picks[x.String()+","+y.String()] = true
+      if recorded := ec.Recorded(); len(recorded) != 2 || !AreEqual(recorded[0], x) || !AreEqual(recorded[1], y) {
+        t.Errorf("run %d picked %v, %v but recorded %v", runs, x, y, recorded)
+      }
+    }
+  })
+  // The searches for y, one per candidate of x, are one choice
+  if runs != 9 || len(picks) != 6 {
+    t.Errorf("%d runs picked %v", runs, picks)
+  }
+}
+
+func TestExhaustiveChoiceExecutions(t *testing.T) {
+  ec := NewExhaustiveChoice(2)
+  var combinations []string
+  withChoiceStrategy(ec, func() {
+    for more := true; more; more = ec.Next() {
+      combination := ""
+      // A statement x :| x in {0, 1} executed twice in a loop
+      for k := 0; k < 2; k++ {
+        x, _ := EnterChoice("loop").Choices(0, SeqOf(Zero, One))()
+        combination += x.(Int).String()
+      }
+      combinations = append(combinations, combination)
+    }
+  })
+  // Each execution is a choice of its own
+  seen := make(map[string]bool)
+  for _, c := range combinations {
+    seen[c] = true
+  }
+  if len(combinations) != 4 || len(seen) != 4 {
+    t.Errorf("runs picked %v", combinations)
+  }
+}
+
+// pickUnbounded runs x, y :| x >= 0 && y in {0, 1} && x == 7 the way compiled
+// code does, searching in rounds of doubling length.
+func pickUnbounded() Int {
+  site := EnterChoice("unbounded")
+  for _iterLimit := 5; ; _iterLimit *= 2 {
+    _iterLimit_0 := _iterLimit
+    for _iter0 := site.Choices(0, IntegerRangeOf(Zero, NilInt)); ; {
+      _x, _ok := _iter0()
+      if !_ok {
+        break
+      }
+      if _iterLimit_0 == 0 {
+        break
+      }
+      _iterLimit_0--
+      for _iter1 := site.Choices(1, SeqOf(Zero, One)); ; {
+        if _, _ok := _iter1(); !_ok {
+          break
+        }
+        if _x.(Int).Cmp(IntOf(7)) == 0 {
+          return _x.(Int)
+        }
+      }
+    }
+  }
+}
+
+func TestExhaustiveChoiceRounds(t *testing.T) {
+  ec := NewExhaustiveChoice(2)
+  runs := 0
+  withChoiceStrategy(ec, func() {
+    for more := true; more; more = ec.Next() {
+      runs++
+      if x := pickUnbounded(); x.Cmp(IntOf(7)) != 0 {
+        t.Errorf("run %d picked %v", runs, x)
+      }
+      // The rounds search for the same two choices
+      if trail := ec.Trail(); len(trail) != 2 {
+        t.Errorf("run %d made choices %v", runs, trail)
+      }
+    }
+  })
+  if runs != 4 {
+    t.Errorf("%d runs", runs)
+  }
+}
+
+func TestRandomChoiceIsDeterministic(t *testing.T) {
+  pick := func(seed int64) []interface{} {
+    var picks []interface{}
+    withChoiceStrategy(NewRandomChoice(seed, 10), func() {
+      for k := 0; k < 5; k++ {
+        v, _ := EnterChoice("random").Choices(0, IntegerRangeOf(Zero, IntOf(10)))()
+        picks = append(picks, v)
+      }
+    })
+    return picks
+  }
+  if a, b := SeqOf(pick(42)...), SeqOf(pick(42)...); !a.Equals(b) {
+    t.Errorf("the same seed picked %v and %v", a, b)
+  }
+}
+
+/******************************************************************************
+ * Subsets
+ ******************************************************************************/
+
+// subsets collects the subsets yielded by an iterator, checking that there
+// are no duplicates.
+func subsets(t *testing.T, it Iterator) []Set {
+  t.Helper()
+  var all []Set
+  for v, ok := it(); ok; v, ok = it() {
+    s := v.(Set)
+    for _, u := range all {
+      if u.Equals(s) {
+        t.Errorf("subset %v is yielded twice", s)
+      }
+    }
+    all = append(all, s)
+  }
+  return all
+}
+
+func TestAllSubsets(t *testing.T) {
+  set := SetOf(One, Two, Five, Ten)
+  all := subsets(t, set.AllSubsets())
+  if len(all) != 16 {
+    t.Errorf("AllSubsets yielded %d subsets", len(all))
+  }
+  for _, s := range all {
+    if !s.IsSubsetOf(set) {
+      t.Errorf("%v isn't a subset of %v", s, set)
+    }
+  }
+  // The subsets are produced lazily, even if there are too many to list
+  values := make([]interface{}, 100)
+  for i := range values {
+    values[i] = IntOf(i)
+  }
+  if count, halt := pull(SetOf(values...).AllSubsets(), 3); count != 3 || halt != nil {
+    t.Errorf("AllSubsets of a large set yielded %d subsets, then %v", count, halt)
+  }
+}
+
+func TestGraySubsets(t *testing.T) {
+  all := subsets(t, SetOf(One, Two, Five).GraySubsets())
+  if len(all) != 8 {
+    t.Fatalf("GraySubsets yielded %d subsets", len(all))
+  }
+  for i := 1; i < len(all); i++ {
+    a, b := all[i-1], all[i]
+    if diff := a.Difference(b).Union(b.Difference(a)); diff.CardinalityInt() != 1 {
+      t.Errorf("consecutive subsets %v and %v differ in %v", a, b, diff)
+    }
+  }
+}
+
+func TestSubsetsOfSize(t *testing.T) {
+  set := SetOf(One, Two, Five, Ten, Zero)
+  for k, want := range []int{1, 5, 10, 10, 5, 1} {
+    all := subsets(t, set.SubsetsOfSize(k))
+    if len(all) != want {
+      t.Errorf("SubsetsOfSize(%d) yielded %d subsets", k, len(all))
+    }
+    for _, s := range all {
+      if s.CardinalityInt() != k {
+        t.Errorf("SubsetsOfSize(%d) yielded %v", k, s)
+      }
+    }
+  }
+  if all := subsets(t, set.SubsetsOfSize(6)); len(all) != 0 {
+    t.Errorf("SubsetsOfSize(6) yielded %v", all)
+  }
+  if all := subsets(t, set.SubsetsBetween(1, 2)); len(all) != 15 {
+    t.Errorf("SubsetsBetween(1, 2) yielded %d subsets", len(all))
+  }
+}
+
+/******************************************************************************
+ * Hashing and multisets
+ ******************************************************************************/
+
+func TestHashAgreesWithEquality(t *testing.T) {
+  pairs := [][2]interface{}{
+    {IntOf(7), IntOfString("7")},
+    {SetOf(One, Two), SetOf(Two, One)},
+    {MultiSetOf(One, Two, One), MultiSetOf(Two, One, One)},
+    {NewMapBuilder().Add(One, Two).Add(Two, One).ToMap(), NewMapBuilder().Add(Two, One).Add(One, Two).ToMap()},
+    {SeqOf(One, SetOf(Two)), SeqOf(One, SetOf(Two))},
+    {TupleOf(One, Five), TupleOf(One, Five)},
+  }
+  for _, p := range pairs {
+    if !AreEqual(p[0], p[1]) {
+      t.Errorf("%v and %v aren't equal", p[0], p[1])
+    } else if Hash(p[0]) != Hash(p[1]) {
+      t.Errorf("%v and %v are equal but hash differently", p[0], p[1])
+    }
+  }
+}
+
+func TestHashOfZeroValuedInt(t *testing.T) {
+  if Hash(Int{}) != Hash(Zero) {
+    t.Error("a zero-valued Int doesn't hash like zero")
+  }
+  if Hash(TupleOf(Int{})) != Hash(TupleOf(Zero)) {
+    t.Error("a tuple of a zero-valued Int doesn't hash like a tuple of zero")
+  }
+}
+
+func TestMultiSetMultiplicities(t *testing.T) {
+  mset := MultiSetOf(One, Two, One, Five, One)
+  if got := mset.Multiplicity(One); got.Cmp(IntOf(3)) != 0 {
+    t.Errorf("multiplicity of 1 in %v is %v", mset, got)
+  }
+  if got := mset.Multiplicity(Ten); got.Sign() != 0 {
+    t.Errorf("multiplicity of 10 in %v is %v", mset, got)
+  }
+  if got := mset.CardinalityInt(); got != 5 {
+    t.Errorf("cardinality of %v is %d", mset, got)
+  }
+  distinct := 0
+  for _, n := range mset.Multiplicities() {
+    if n.Sign() <= 0 {
+      t.Errorf("%v has a multiplicity of %v", mset, n)
+    }
+    distinct++
+  }
+  if distinct != 3 {
+    t.Errorf("%v has %d distinct elements", mset, distinct)
+  }
+}
+
+func TestMultiSetZeroCountsAreNormalized(t *testing.T) {
+  mset := MultiSetOf(One, Two, One)
+  without := mset.Update(Two, Zero)
+  if without.Contains(Two) || !without.Equals(MultiSetOf(One, One)) {
+    t.Errorf("%v[2 := 0] is %v", mset, without)
+  }
+  if Hash(without) != Hash(MultiSetOf(One, One)) {
+    t.Errorf("%v hashes unlike an equal multiset built without 2", without)
+  }
+  if d := mset.Difference(MultiSetOf(Two, Two)); d.Contains(Two) || !d.Equals(MultiSetOf(One, One)) {
+    t.Errorf("%v - multiset{2, 2} is %v", mset, d)
+  }
+  if i := mset.Intersection(MultiSetOf(Five)); i.CardinalityInt() != 0 || !i.Equals(EmptyMultiSet) {
+    t.Errorf("%v * multiset{5} is %v", mset, i)
+  }
+  var zero Int
+  if got := mset.Update(Two, zero); !got.Equals(without) {
+    t.Errorf("%v[2 := zero-valued Int] is %v", mset, got)
+  }
+}
+
+func TestMultiSetLargeMultiplicities(t *testing.T) {
+  huge := IntOfString("100000000000000000000")
+  mset := EmptyMultiSet.Update(One, huge)
+  doubled := mset.Union(mset)
+  if got := doubled.Multiplicity(One); got.Cmp(huge.Plus(huge)) != 0 {
+    t.Errorf("multiplicity of 1 in %v + itself is %v", mset, got)
+  }
+  if got := doubled.Difference(mset); !got.Equals(mset) {
+    t.Errorf("(m + m) - m is %v", got)
+  }
+  if !mset.IsProperSubsetOf(doubled) || doubled.IsSubsetOf(mset) {
+    t.Errorf("subset relations between %v and %v are wrong", mset, doubled)
+  }
+}
+
+/******************************************************************************
+ * Map builders
+ ******************************************************************************/
+
+// halts reports whether f halts, along with the halt.
+func halts(f func()) (halted bool, halt interface{}) {
+  defer func() {
+    if r := recover(); r != nil {
+      halted, halt = true, r
+    }
+  }()
+  f()
+  return false, nil
+}
+
+func TestMapBuilderReplacesDuplicateKeys(t *testing.T) {
+  m := NewMapBuilder().Add(One, Two).Add(Five, Ten).Add(IntOf(1), Five).ToMap()
+  if m.CardinalityInt() != 2 || !AreEqual(m.Get(One), Five) {
+    t.Errorf("map[1 := 2, 5 := 10, 1 := 5] is %v", m)
+  }
+}
+
+func TestStrictMapBuilder(t *testing.T) {
+  mb := NewStrictMapBuilder().Add(One, Two).Add(IntOf(1), IntOf(2))
+  if m := mb.ToMap(); m.CardinalityInt() != 1 {
+    t.Errorf("adding the same key and value twice gave %v", m)
+  }
+  if halted, halt := halts(func() { mb.Add(One, Five) }); !halted {
+    t.Error("a strict map builder doesn't halt on a conflicting value")
+  } else if msg := fmt.Sprint(halt); !strings.Contains(msg, "two different values") {
+    t.Errorf("the conflict halts with %q", msg)
+  }
+}
+
+func TestMapBuilderDoesNotChangeBuiltMaps(t *testing.T) {
+  mb := NewMapBuilder().Add(One, Two)
+  m := mb.ToMap()
+  mb.Add(One, Five).Add(Ten, Ten)
+  if m.CardinalityInt() != 1 || !AreEqual(m.Get(One), Two) {
+    t.Errorf("a map built earlier changed to %v", m)
+  }
+  if m2 := mb.ToMap(); m2.CardinalityInt() != 2 || !AreEqual(m2.Get(One), Five) {
+    t.Errorf("the builder then built %v", m2)
+  }
+}
+
+/******************************************************************************
+ * Builders
+ ******************************************************************************/
+
+func TestSeqBuilder(t *testing.T) {
+  sb := NewSeqBuilder()
+  sb.Reserve(10)
+  sb.Add(One).AddAll(SeqOf(Two, Five)).Add(Ten)
+  if s := sb.ToSeq(); !s.Equals(SeqOf(One, Two, Five, Ten)) {
+    t.Errorf("the builder built %v", s)
+  }
+  if sb.Len() != 4 {
+    t.Errorf("the builder has %d elements", sb.Len())
+  }
+  built := sb.ToSeq()
+  sb.Add(Zero)
+  if built.CardinalityInt() != 4 {
+    t.Errorf("a sequence built earlier changed to %v", built)
+  }
+  sb.Reset()
+  if s := sb.ToSeq(); s.CardinalityInt() != 0 {
+    t.Errorf("after Reset, the builder built %v", s)
+  }
+  if s := NewStringBuilder().Add(Char('h')).Add(Char('i')).ToSeq(); s.ToGoString() != "hi" {
+    t.Errorf("the string builder built %v", s)
+  }
+}
+
+func TestMultiSetBuilder(t *testing.T) {
+  mb := NewMultiSetBuilder()
+  mb.Reserve(3)
+  mb.Add(One).Add(Two).AddCount(One, Two).AddCount(Five, Zero)
+  mset := mb.ToMultiSet()
+  if !mset.Equals(MultiSetOf(One, One, One, Two)) {
+    t.Errorf("the builder built %v", mset)
+  }
+  mb.Add(Two)
+  if !mset.Equals(MultiSetOf(One, One, One, Two)) {
+    t.Errorf("a multiset built earlier changed to %v", mset)
+  }
+  if b := (&Builder{One, Two, One}); !b.ToMultiSet().Equals(MultiSetOf(One, One, Two)) || !b.ToSeq().Equals(SeqOf(One, Two, One)) {
+    t.Errorf("a Builder of %v builds the wrong collections", *b)
+  }
+}
+
+/******************************************************************************
+ * Map views
+ ******************************************************************************/
+
+func TestMapViews(t *testing.T) {
+  m := NewMapBuilder().Add(One, Ten).Add(Two, Ten).Add(Five, Zero).ToMap()
+  keys, values, items := m.Keys(), m.Values(), m.Items()
+
+  if !keys.Contains(Two) || keys.Contains(Ten) || keys.CardinalityInt() != 3 {
+    t.Errorf("the keys of %v are wrong", m)
+  }
+  if !values.Contains(Ten) || values.Contains(One) {
+    t.Errorf("the values of %v are wrong", m)
+  }
+  if !items.Contains(TupleOf(Five, Zero)) || items.Contains(TupleOf(Five, Ten)) || items.Contains(One) {
+    t.Errorf("the items of %v are wrong", m)
+  }
+  for _, view := range []Set{keys, items} {
+    if view.lazyView() == nil {
+      t.Errorf("%v was built by a membership test or cardinality", view)
+    }
+  }
+
+  for _, test := range []struct {
+    view, want Set
+  }{
+    {keys, SetOf(One, Two, Five)},
+    {values, SetOf(Ten, Zero)},
+    {items, SetOf(TupleOf(One, Ten), TupleOf(Two, Ten), TupleOf(Five, Zero))},
+  } {
+    if !test.view.Equals(test.want) || !test.want.Equals(test.view) {
+      t.Errorf("view %v isn't equal to %v", test.view, test.want)
+    }
+    if test.view.CardinalityInt() != test.want.CardinalityInt() {
+      t.Errorf("view %v has cardinality %d", test.view, test.view.CardinalityInt())
+    }
+    if Hash(test.view) != Hash(test.want) {
+      t.Errorf("view %v hashes unlike %v", test.view, test.want)
+    }
+  }
+}
+
+func TestMapViewsAreSafeToShare(t *testing.T) {
+  m := NewMapBuilder().Add(One, Two).Add(Two, Two).ToMap()
+  values := m.Values()
+  var wg sync.WaitGroup
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      if values.CardinalityInt() != 1 {
+        t.Errorf("the values of %v are %v", m, values)
+      }
+    }()
+  }
+  wg.Wait()
+}
+
+/******************************************************************************
+ * Ordering
+ ******************************************************************************/
+
+// Tree is a datatype as the compiler emits it:
+//   datatype Tree = Leaf | Node(value: int, labels: seq<int>, tags: set<int>)
+type Tree struct {
+  Data_Tree_
+}
+
+type Data_Tree_ interface {
+  isTree()
+}
+
+type Tree_Leaf struct{}
+
+func (Tree_Leaf) isTree() {}
+
+type Tree_Node struct {
+  Value  Int
+  Labels Seq
+  Tags   Set
+}
+
+func (Tree_Node) isTree() {}
+
+func (_this Tree) Equals(other Tree) bool {
+  switch data1 := _this.Data_Tree_.(type) {
+  case Tree_Leaf:
+    _, ok := other.Data_Tree_.(Tree_Leaf)
+    return ok
+  case Tree_Node:
+    data2, ok := other.Data_Tree_.(Tree_Node)
+    return ok && data1.Value.Cmp(data2.Value) == 0 && data1.Labels.Equals(data2.Labels) && data1.Tags.Equals(data2.Tags)
+  default:
+    return false
+  }
+}
+
+func (_this Tree) EqualsGeneric(other interface{}) bool {
+  typed, ok := other.(Tree)
+  return ok && _this.Equals(typed)
+}
+
+func node(value Int, labels Seq, tags Set) Tree {
+  return Tree{Tree_Node{value, labels, tags}}
+}
+
+func TestCompareDatatypesByValue(t *testing.T) {
+  // The larger Int is allocated first, so that comparing the representations
+  // of the Ints would likely give the wrong answer
+  ten, two := IntOfString("10"), IntOfString("2")
+  tests := []struct {
+    x, y Tree
+    want int
+  }{
+    {node(ten, SeqOf(), SetOf()), node(two, SeqOf(), SetOf()), 1},
+    {node(two, SeqOf(), SetOf()), node(ten, SeqOf(), SetOf()), -1},
+    {node(One, SeqOf(ten), SetOf()), node(One, SeqOf(two, One), SetOf()), 1},
+    {node(One, SeqOf(), SetOf(One, Two)), node(One, SeqOf(), SetOf(Two, One)), 0},
+    {node(One, SeqOf(), SetOf(One, Five)), node(One, SeqOf(), SetOf(Two, One)), 1},
+    {Tree{Tree_Leaf{}}, node(One, SeqOf(), SetOf()), -1},
+  }
+  for _, test := range tests {
+    if got := Compare(test.x, test.y); got != test.want {
+      t.Errorf("Compare(%v, %v) = %d, want %d", test.x, test.y, got, test.want)
+    }
+    if got := Compare(test.y, test.x); got != -test.want {
+      t.Errorf("Compare(%v, %v) = %d, want %d", test.y, test.x, got, -test.want)
+    }
+  }
+}
+
+func TestSortDatatypes(t *testing.T) {
+  trees := SeqOf(
+    node(IntOfString("10"), SeqOf(), SetOf()),
+    node(IntOfString("2"), SeqOf(), SetOf()),
+    node(IntOfString("-3"), SeqOf(), SetOf()),
+    node(IntOfString("2"), SeqOf(One), SetOf()),
+  )
+  sorted := trees.Sorted()
+  want := []string{"-3", "2", "2", "10"}
+  for i := 0; i < sorted.CardinalityInt(); i++ {
+    value := sorted.IndexInt(i).(Tree).Data_Tree_.(Tree_Node).Value
+    if value.String() != want[i] {
+      t.Errorf("sorted %v is %v", trees, sorted)
+      break
+    }
+  }
+  for i := 1; i < sorted.CardinalityInt(); i++ {
+    if Compare(sorted.IndexInt(i-1), sorted.IndexInt(i)) > 0 {
+      t.Errorf("sorted %v isn't in order: %v", trees, sorted)
+    }
+  }
+}
+
+func TestCompareIsTotal(t *testing.T) {
+  values := []interface{}{
+    nil, false, true, Char('a'), IntOf(-1), One, Ten, SeqOf(), SeqOf(One), SeqOfString("ab"),
+    TupleOf(One, Two), SetOf(), SetOf(One), MultiSetOf(One, One), NewMapBuilder().Add(One, Two).ToMap(),
+    node(One, SeqOf(), SetOf()),
+  }
+  for i, x := range values {
+    for j, y := range values {
+      c := Compare(x, y)
+      if (c == 0) != (i == j) || c != -Compare(y, x) {
+        t.Errorf("Compare(%v, %v) = %d", x, y, c)
+      }
+    }
+  }
+}
+
+/******************************************************************************
+ * Sorted sets and maps
+ ******************************************************************************/
+
+// randomTree returns a tree whose Ints are all freshly allocated, so that equal
+// trees don't share their representations.
+func randomTree(rng *rand.Rand) Tree {
+  if rng.Intn(8) == 0 {
+    return Tree{Tree_Leaf{}}
+  }
+  fresh := func() Int { return IntOfString(strconv.Itoa(rng.Intn(4))) }
+  return node(fresh(), SeqOf(fresh()), SetOf(fresh(), fresh()))
+}
+
+// bruteFloor and bruteCeiling find the greatest element at most, and the least
+// element at least, a value.
+func bruteFloor(set Set, value interface{}) (interface{}, bool) {
+  var best interface{}
+  found := false
+  for _, v := range set.elements() {
+    if Compare(v, value) <= 0 && (!found || Compare(v, best) > 0) {
+      best, found = v, true
+    }
+  }
+  return best, found
+}
+
+func bruteCeiling(set Set, value interface{}) (interface{}, bool) {
+  var best interface{}
+  found := false
+  for _, v := range set.elements() {
+    if Compare(v, value) >= 0 && (!found || Compare(v, best) < 0) {
+      best, found = v, true
+    }
+  }
+  return best, found
+}
+
+func TestSortedSetBehavesLikeSet(t *testing.T) {
+  rng := rand.New(rand.NewSource(1))
+  for round := 0; round < 50; round++ {
+    values := make([]interface{}, 20)
+    for i := range values {
+      values[i] = randomTree(rng)
+    }
+    set, sorted := SetOf(values...), SortedSetOf(values...)
+    if sorted.CardinalityInt() != set.CardinalityInt() {
+      t.Fatalf("%v has %d elements, but %v has %d", sorted, sorted.CardinalityInt(), set, set.CardinalityInt())
+    }
+    if !AreEqual(sorted, set) || !AreEqual(sorted, SortedSetFrom(set)) {
+      t.Fatalf("%v isn't equal to %v", sorted, set)
+    }
+    for i := 0; i < 20; i++ {
+      probe := randomTree(rng)
+      if sorted.Contains(probe) != set.Contains(probe) {
+        t.Errorf("%v and %v disagree on whether they contain %v", sorted, set, probe)
+      }
+      got, ok := sorted.Floor(probe)
+      want, wantOk := bruteFloor(set, probe)
+      if ok != wantOk || (ok && !AreEqual(got, want)) {
+        t.Errorf("the floor of %v in %v is %v, want %v", probe, sorted, got, want)
+      }
+      got, ok = sorted.Ceiling(probe)
+      want, wantOk = bruteCeiling(set, probe)
+      if ok != wantOk || (ok && !AreEqual(got, want)) {
+        t.Errorf("the ceiling of %v in %v is %v, want %v", probe, sorted, got, want)
+      }
+      inserted := sorted.Insert(probe)
+      if !AreEqual(inserted, set.Union(SetOf(probe))) {
+        t.Errorf("%v with %v inserted is %v", sorted, probe, inserted)
+      }
+      if removed := inserted.Remove(probe); !AreEqual(removed, set.Difference(SetOf(probe))) {
+        t.Errorf("%v with %v removed is %v", inserted, probe, removed)
+      }
+    }
+  }
+}
+
+func TestSortedMapBehavesLikeMap(t *testing.T) {
+  rng := rand.New(rand.NewSource(2))
+  for round := 0; round < 50; round++ {
+    mb := NewMapBuilder()
+    for i := 0; i < 20; i++ {
+      mb.Add(randomTree(rng), IntOf(i))
+    }
+    m := mb.ToMap()
+    sorted := SortedMapFrom(m)
+    if sorted.CardinalityInt() != m.CardinalityInt() || !AreEqual(sorted, m) {
+      t.Fatalf("%v isn't equal to %v", sorted, m)
+    }
+    for i := 0; i < 20; i++ {
+      probe := randomTree(rng)
+      got, ok := sorted.Find(probe)
+      want, wantOk := m.Find(probe)
+      if ok != wantOk || (ok && !AreEqual(got, want)) {
+        t.Errorf("%v maps %v to %v, but %v maps it to %v", sorted, probe, got, m, want)
+      }
+      key, _, ok := sorted.Floor(probe)
+      wantKey, wantOk := bruteFloor(m.Keys(), probe)
+      if ok != wantOk || (ok && !AreEqual(key, wantKey)) {
+        t.Errorf("the floor of %v in %v is %v, want %v", probe, sorted, key, wantKey)
+      }
+      key, _, ok = sorted.Ceiling(probe)
+      wantKey, wantOk = bruteCeiling(m.Keys(), probe)
+      if ok != wantOk || (ok && !AreEqual(key, wantKey)) {
+        t.Errorf("the ceiling of %v in %v is %v, want %v", probe, sorted, key, wantKey)
+      }
+      if updated := sorted.Update(probe, Ten); !AreEqual(updated, m.Update(probe, Ten)) {
+        t.Errorf("%v with %v updated is %v", sorted, probe, updated)
+      }
+    }
+  }
+}
+
+/******************************************************************************
+ * Formatting
+ ******************************************************************************/
+
+func TestFormatVerbs(t *testing.T) {
+  s := SeqOfString("hi\n")
+  tests := []struct {
+    format string
+    value  interface{}
+    want   string
+  }{
+    {"%v", IntOf(255), "255"},
+    {"%d", IntOf(255), "255"},
+    {"%x", IntOf(255), "ff"},
+    {"%X", IntOf(255), "FF"},
+    {"%o", IntOf(255), "377"},
+    {"%b", IntOf(5), "101"},
+    {"%x", Char('a'), "61"},
+    {"%x", SeqOf(Ten, IntOf(255)), "[a, ff]"},
+    {"%v", Char('a'), "a"},
+    {"%q", Char('\n'), `'\n'`},
+    {"%q", s, `"hi\n"`},
+    {"%s", SeqOfString("ab"), "ab"},
+    {"%v", RealOfString("1.5"), "1.5"},
+    {"[%5v]", IntOf(42), "[   42]"},
+    {"[%-5v]", IntOf(42), "[42   ]"},
+    {"[%7v]", SetOf(One), "[    {1}]"},
+    {"%#v", IntOf(255), "dafny.IntOfInt64(255)"},
+    {"%#v", Int{}, "dafny.IntOfInt64(0)"},
+    {"%d", Int{}, "0"},
+    {"%x", Int{}, "0"},
+    {"%v", Int{}, "0"},
+    {"%#v", Char('\n'), `dafny.Char('\n')`},
+    {"%#v", s, `dafny.SeqOfString("hi\n")`},
+    {"%#v", SeqOf(s, One), `dafny.SeqOf(dafny.SeqOfString("hi\n"), dafny.IntOfInt64(1))`},
+    {"%#v", MultiSetOf(One, One), "dafny.MultiSetOf(dafny.IntOfInt64(1), dafny.IntOfInt64(1))"},
+    {"%#v", NewMapBuilder().Add(One, Char('v')).ToMap(), "dafny.NewMapBuilder().Add(dafny.IntOfInt64(1), dafny.Char('v')).ToMap()"},
+  }
+  for _, test := range tests {
+    if got := fmt.Sprintf(test.format, test.value); got != test.want {
+      t.Errorf("Sprintf(%q, %s) = %q, want %q", test.format, String(test.value), got, test.want)
+    }
+  }
+}
+
+/******************************************************************************
+ * Printing
+ ******************************************************************************/
+
+func TestPrintNestedCharsAndStrings(t *testing.T) {
+  s := SeqOfString("hi\n")
+  tests := []struct {
+    value interface{}
+    want  string
+  }{
+    {Char('a'), "a"},
+    {s, "hi\n"},
+    {SeqOf(s, SeqOfString("x")), `["hi\n", "x"]`},
+    {SetOf(Char('a')), "{'a'}"},
+    {SeqOf(Char('\'')), "'"},
+    {SetOf(SeqOfString(`say "hi"`)), `{"say \"hi\""}`},
+    {TupleOf(Char('c'), s), `('c', "hi\n")`},
+    {NewMapBuilder().Add(SeqOfString("k"), Char('v')).ToMap(), `map["k" := 'v']`},
+    {SeqOf(SetOf(Char('\\'))), `[{'\\'}]`},
+  }
+  for _, test := range tests {
+    if got := String(test.value); got != test.want {
+      t.Errorf("String(%#v) = %q, want %q", test.value, got, test.want)
+    }
+  }
+}
+
+/******************************************************************************
+ * Output
+ ******************************************************************************/
+
+func TestCaptureOutput(t *testing.T) {
+  got := CaptureOutput(func() {
+    Print(SeqOfString("a"))
+    done := make(chan struct{})
+    go func() {
+      Print(Char('b'))
+      close(done)
+    }()
+    <-done
+    io.WriteString(Output(), "c")
+  })
+  if got != "abc" {
+    t.Errorf("CaptureOutput = %q, want %q", got, "abc")
+  }
+}
+
+func TestNestedRedirectOutput(t *testing.T) {
+  var outer, inner strings.Builder
+  RedirectOutput(&outer, func() {
+    Print(Char('a'))
+    RedirectOutput(&inner, func() {
+      Print(Char('b'))
+    })
+    Print(Char('c'))
+  })
+  if outer.String() != "ac" || inner.String() != "b" {
+    t.Errorf("outer = %q, inner = %q, want \"ac\" and \"b\"", outer.String(), inner.String())
+  }
+}
+
+func TestConcurrentCaptureOutput(t *testing.T) {
+  var w strings.Builder
+  prev := SetOutput(&w)
+  defer SetOutput(prev)
+
+  const n = 100
+  var wg sync.WaitGroup
+  got := make([]string, 4)
+  for i := range got {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      got[i] = CaptureOutput(func() {
+        for range n {
+          Print(IntOf(i))
+          runtime.Gosched()
+        }
+      })
+    }()
+  }
+  Print(Char('x'))
+  wg.Wait()
+  for i, out := range got {
+    if want := strings.Repeat(strconv.Itoa(i), n); out != want {
+      t.Errorf("capture %d = %q, want %q", i, out, want)
+    }
+  }
+  if w.String() != "x" {
+    t.Errorf("output outside the captures = %q, want %q", w.String(), "x")
+  }
+}
+
+func TestBufferedOutput(t *testing.T) {
+  var w strings.Builder
+  prev := SetOutput(&w)
+  defer SetOutput(prev)
+  SetOutputBuffering(64)
+  defer SetOutputBuffering(0)
+
+  Print(SeqOfString("buffered"))
+  if w.Len() != 0 {
+    t.Errorf("output %q written before FlushOutput", w.String())
+  }
+  if err := FlushOutput(); err != nil {
+    t.Fatal(err)
+  }
+  if w.String() != "buffered" {
+    t.Errorf("output = %q after FlushOutput, want %q", w.String(), "buffered")
+  }
+}
+
+/******************************************************************************
+ * String-ness
+ ******************************************************************************/
+
+func TestStringness(t *testing.T) {
+  empty := SeqOfString("")
+  tests := []struct {
+    name string
+    seq  Seq
+    want string
+  }{
+    {"empty string", empty, ""},
+    {"empty sequence", SeqOf(), "[]"},
+    {"empty string with element type", SeqOf().WithElementType(CharType), ""},
+    {"concatenation of empty strings", empty.Concat(SeqOfString("")), ""},
+    {"concatenation with an empty sequence", SeqOf().Concat(empty), ""},
+    {"subsequence of a string", SeqOfString("abc").Subseq(One, One), ""},
+    {"update of a string", SeqOfString("abc").UpdateInt(0, Char('x')), "xbc"},
+    {"sequence of characters", SeqOf(Char('a'), Char('b')), "ab"},
+    {"marked string", SeqOf().SetString(), ""},
+  }
+  for _, test := range tests {
+    if got := String(test.seq); got != test.want {
+      t.Errorf("%s prints as %q, want %q", test.name, got, test.want)
+    }
+  }
+  if !isCharType(SeqOfString("").Concat(SeqOf(Char('a'))).ElementType()) {
+    t.Error("concatenating a string with characters loses its element type")
+  }
+  if got := String(SeqOf(empty, SeqOf())); got != `["", []]` {
+    t.Errorf("a sequence of an empty string and an empty sequence prints as %q", got)
+  }
+}
+
+func TestSeqOfNonASCIIString(t *testing.T) {
+  for _, str := range []string{"", "ascii", "héllo", "日本語", "a😀b"} {
+    seq := SeqOfString(str)
+    if got, want := seq.LenInt(), len([]rune(str)); got != want {
+      t.Errorf("SeqOfString(%q) has length %d, want %d", str, got, want)
+    }
+    if got := seq.ToGoString(); got != str {
+      t.Errorf("SeqOfString(%q).ToGoString() = %q", str, got)
+    }
+    if got := String(seq); got != str {
+      t.Errorf("String(SeqOfString(%q)) = %q", str, got)
+    }
+  }
+}
+
+/******************************************************************************
+ * Cancellation
+ ******************************************************************************/
+
+// spin calls CheckCanceled until it halts.
+func spin() {
+  for {
+    CheckCanceled()
+  }
+}
+
+func TestCallCanceled(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  time.AfterFunc(10*time.Millisecond, cancel)
+  if err := Call(ctx, spin); err != context.Canceled {
+    t.Errorf("Call = %v, want %v", err, context.Canceled)
+  }
+}
+
+func TestCallDeadline(t *testing.T) {
+  ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+  defer cancel()
+  if err := Call(ctx, spin); err != context.DeadlineExceeded {
+    t.Errorf("Call = %v, want %v", err, context.DeadlineExceeded)
+  }
+}
+
+func TestCallAlreadyCanceled(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  cancel()
+  ran := false
+  if err := Call(ctx, func() { ran = true }); err != context.Canceled || ran {
+    t.Errorf("Call = %v and ran = %v, want %v and false", err, ran, context.Canceled)
+  }
+}
+
+func TestCallHalt(t *testing.T) {
+  err := Call(context.Background(), func() { panic("oops") })
+  var halt *HaltError
+  if !errors.As(err, &halt) || halt.Value != "oops" {
+    t.Errorf("Call = %v, want a HaltError for \"oops\"", err)
+  }
+  if err := Call(context.Background(), func() {}); err != nil {
+    t.Errorf("Call = %v, want nil", err)
+  }
+}
+
+func TestCancellationReachesGoroutines(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  halted := make(chan interface{})
+  err := Call(ctx, func() {
+    go func() {
+      defer func() { halted <- recover() }()
+      spin()
+    }()
+    cancel()
+    if r := <-halted; r != (CancellationHalt{context.Canceled}) {
+      t.Errorf("goroutine halted with %v, want a CancellationHalt", r)
+    }
+  })
+  if err != nil {
+    t.Errorf("Call = %v, want nil", err)
+  }
+}
+
+type contextKey struct{}
+
+func TestContext(t *testing.T) {
+  ctx := context.WithValue(context.Background(), contextKey{}, "value")
+  ctx = pprof.WithLabels(ctx, pprof.Labels("call", "yes"))
+  pprof.Do(context.Background(), pprof.Labels("caller", "yes"), func(context.Context) {
+    Call(ctx, func() {
+      if got := Context().Value(contextKey{}); got != "value" {
+        t.Errorf("Context() inside Call has value %v, want %q", got, "value")
+      }
+      for _, key := range []string{"call", "caller"} {
+        if got, _ := pprof.Label(Context(), key); got != "yes" {
+          t.Errorf("Context() inside Call has label %s = %q, want %q", key, got, "yes")
+        }
+      }
+    })
+  })
+  if Context() != context.Background() {
+    t.Errorf("Context() = %v outside Call, want context.Background()", Context())
+  }
+  // Outside of Call, there's nothing to cancel
+  CheckCanceled()
+}
+
+func TestConcurrentCalls(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  started, checked := make(chan struct{}), make(chan struct{})
+  canceled := make(chan error)
+  go func() {
+    canceled <- Call(ctx, func() {
+      close(started)
+      <-checked
+      spin()
+    })
+  }()
+  <-started
+
+  err := Call(context.Background(), func() {
+    cancel()
+    for pendingCancellations.Load() == 0 {
+      runtime.Gosched()
+    }
+    // The other call's cancellation doesn't stop this one
+    CheckCanceled()
+    close(checked)
+    if err := <-canceled; err != context.Canceled {
+      t.Errorf("canceled Call = %v, want %v", err, context.Canceled)
+    }
+  })
+  if err != nil {
+    t.Errorf("Call running alongside a canceled one = %v, want nil", err)
+  }
+}
+
+func TestNestedCall(t *testing.T) {
+  var inner, outer error
+  got := CaptureOutput(func() {
+    outer = Call(context.Background(), func() {
+      ctx, cancel := context.WithCancel(Context())
+      inner = Call(ctx, func() {
+        Print(SeqOfString("inner"))
+        cancel()
+        spin()
+      })
+      Print(SeqOfString(" outer"))
+      CheckCanceled()
+    })
+  })
+  if inner != context.Canceled || outer != nil {
+    t.Errorf("inner Call = %v and outer Call = %v, want %v and nil", inner, outer, context.Canceled)
+  }
+  if got != "inner outer" {
+    t.Errorf("nested calls printed %q, want %q", got, "inner outer")
+  }
+
+  ctx, cancel := context.WithCancel(context.Background())
+  outer = Call(ctx, func() {
+    inner = Call(Context(), func() {
+      cancel()
+      spin()
+    })
+    spin()
+  })
+  if inner != context.Canceled || outer != context.Canceled {
+    t.Errorf("inner Call = %v and outer Call = %v, want both %v", inner, outer, context.Canceled)
+  }
+}
+
+/******************************************************************************
+ * Runtime statistics
+ ******************************************************************************/
+
+func TestStatsAreOffByDefault(t *testing.T) {
+  before := ReadStats()
+  SeqOfString("abc").Concat(SeqOfString("def"))
+  IntOf(1).Plus(IntOf(2))
+  if after := ReadStats(); after.SeqConcats != before.SeqConcats || after.SeqSizes.Total() != before.SeqSizes.Total() {
+    t.Errorf("stats went from %+v to %+v while off", before, after)
+  }
+}
+
+func TestStats(t *testing.T) {
+  defer EnableStats(EnableStats(true))
+  before := ReadStats()
+  SeqOfString("abc").Concat(SeqOfString("def"))
+  SetOf(One, Two, Two)
+  after := ReadStats()
+  if n := after.SeqConcats - before.SeqConcats; n != 1 {
+    t.Errorf("counted %d concatenations, want 1", n)
+  }
+  if n := after.SeqConcatElements - before.SeqConcatElements; n != 6 {
+    t.Errorf("counted %d concatenated elements, want 6", n)
+  }
+  // The set of two elements is in the bucket for sizes 2 and 3
+  if n := after.SetSizes.Counts[2] - before.SetSizes.Counts[2]; n != 1 {
+    t.Errorf("counted %d sets of size 2, want 1", n)
+  }
+}
+
+func TestConcurrentStats(t *testing.T) {
+  defer EnableStats(EnableStats(true))
+  before := ReadStats().SeqConcats
+  var wg sync.WaitGroup
+  for i := 0; i < 8; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for j := 0; j < 1000; j++ {
+        SeqOf(One).Concat(SeqOf(Two))
+      }
+    }()
+  }
+  wg.Wait()
+  if n := ReadStats().SeqConcats - before; n != 8000 {
+    t.Errorf("counted %d concatenations, want 8000", n)
+  }
+}
+
+/******************************************************************************
+ * Call profiling
+ ******************************************************************************/
+
+// profiled calls f with profiling on and a fresh profile, and returns the
+// statistics of the named calls.
+func profiled(f func()) map[string]CallStats {
+  ResetCallProfile()
+  defer ResetCallProfile()
+  defer EnableProfiling(EnableProfiling(true))
+  f()
+  stats := make(map[string]CallStats)
+  for _, s := range CallProfile() {
+    stats[s.Name] = s
+  }
+  return stats
+}
+
+// profiledFunc is the way compiled code reports its calls.
+func profiledFunc(name string, body func()) {
+  if ProfilingEnabled() {
+    defer ProfileCall(name)()
+  }
+  body()
+}
+
+func TestProfilingIsOffByDefault(t *testing.T) {
+  if ProfilingEnabled() {
+    t.Error("profiling is on by default")
+  }
+}
+
+func TestProfileNestedCalls(t *testing.T) {
+  var fact func(n int)
+  fact = func(n int) {
+    profiledFunc("Fact", func() {
+      time.Sleep(time.Millisecond)
+      if n > 0 {
+        fact(n - 1)
+      }
+    })
+  }
+  stats := profiled(func() {
+    profiledFunc("Main", func() { fact(3) })
+  })
+  main, f := stats["Main"], stats["Fact"]
+  if main.Calls != 1 || f.Calls != 4 {
+    t.Fatalf("calls = %d and %d, want 1 and 4", main.Calls, f.Calls)
+  }
+  // Recursive calls are counted once in Time, but each in SelfTime
+  if f.Time > main.Time || f.SelfTime < f.Time-time.Millisecond/2 {
+    t.Errorf("Fact's time %v and self time %v, with Main's time %v", f.Time, f.SelfTime, main.Time)
+  }
+  if main.SelfTime >= main.Time/2 {
+    t.Errorf("Main's self time %v includes the time of its calls (%v in all)", main.SelfTime, main.Time)
+  }
+}
+
+func TestProfileHaltedCalls(t *testing.T) {
+  stats := profiled(func() {
+    halts(func() {
+      profiledFunc("Outer", func() {
+        profiledFunc("Inner", func() { panic("oops") })
+      })
+    })
+    profiledFunc("Outer", func() {})
+  })
+  if stats["Outer"].Calls != 2 || stats["Inner"].Calls != 1 {
+    t.Errorf("stats = %v, want 2 calls of Outer and 1 of Inner", stats)
+  }
+}
+
+func TestProfileConcurrentCalls(t *testing.T) {
+  stats := profiled(func() {
+    var wg sync.WaitGroup
+    for i := 0; i < 8; i++ {
+      wg.Add(1)
+      go func() {
+        defer wg.Done()
+        for j := 0; j < 20; j++ {
+          profiledFunc("Worker", func() {
+            profiledFunc("Step", func() { time.Sleep(time.Millisecond) })
+          })
+        }
+      }()
+    }
+    wg.Wait()
+  })
+  worker, step := stats["Worker"], stats["Step"]
+  if worker.Calls != 160 || step.Calls != 160 {
+    t.Fatalf("stats = %v, want 160 calls of each", stats)
+  }
+  // Concurrent calls are neither nested in nor recursive with each other
+  if step.Time < 160*time.Millisecond || worker.Time < step.Time || worker.SelfTime >= worker.Time/2 {
+    t.Errorf("Worker's time %v and self time %v, with Step's time %v", worker.Time, worker.SelfTime, step.Time)
+  }
+}
+
+func TestProfileNestedInGoroutine(t *testing.T) {
+  stats := profiled(func() {
+    profiledFunc("Outer", func() {
+      done := make(chan struct{})
+      go func() {
+        defer close(done)
+        profiledFunc("Outer", func() {
+          if frame := currentState().frame; frame.outermost || frame.parent == nil || frame.parent.name != "Outer" {
+            t.Error("a call made by a goroutine that a call started isn't nested in it")
+          }
+        })
+      }()
+      <-done
+    })
+  })
+  if stats["Outer"].Calls != 2 {
+    t.Errorf("stats = %v, want 2 calls of Outer", stats)
+  }
+}
+
+func TestProfileKeepsLabels(t *testing.T) {
+  profiled(func() {
+    pprof.Do(context.Background(), pprof.Labels("caller", "yes"), func(context.Context) {
+      before := getProfLabel()
+      profiledFunc("F", func() {
+        if got, _ := pprof.Label(Context(), "caller"); got != "yes" {
+          t.Errorf("caller's label is %q inside a profiled call, want %q", got, "yes")
+        }
+        if got, _ := pprof.Label(Context(), ProfileCallLabel); got != "F" {
+          t.Errorf("%s label is %q inside a profiled call, want %q", ProfileCallLabel, got, "F")
+        }
+      })
+      if getProfLabel() != before {
+        t.Error("a profiled call doesn't restore its goroutine's labels")
+      }
+    })
+  })
+}
+
+var allocSink []byte
+
+// allocating is profiled like a compiled function, and allocates n KiB.
+func allocating(n int) {
+  if ProfilingEnabled() {
+    defer ProfileCall("Allocating")()
+  }
+  for i := 0; i < n; i++ {
+    allocSink = make([]byte, 1024)
+  }
+}
+
+func TestProfileAllocations(t *testing.T) {
+  const n = 64 * 1024
+  stats := profiled(func() {
+    profiledFunc("Other", func() {})
+    allocating(n)
+    // The heap profile covers allocations up to the last garbage collection
+    runtime.GC()
+    runtime.GC()
+  })
+  a := stats["Allocating"]
+  if a.Allocs < n/2 || a.Allocs > 2*n || a.AllocBytes < n*1024/2 || a.AllocBytes > 2*n*1024 {
+    t.Errorf("Allocating's allocations are estimated at %d objects and %d bytes, want about %d and %d", a.Allocs, a.AllocBytes, n, n*1024)
+  }
+}
+
+func TestWriteCallProfile(t *testing.T) {
+  var w strings.Builder
+  profiled(func() {
+    profiledFunc("M.F", func() {})
+    WriteCallProfile(&w)
+  })
+  lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+  if len(lines) != 2 || !strings.HasSuffix(lines[0], "name") || !strings.HasSuffix(lines[1], "M.F") {
+    t.Errorf("WriteCallProfile wrote %q", w.String())
+  }
+}
+
+/******************************************************************************
+ * Random generation
+ ******************************************************************************/
+
+func TestGenerateNativeIntegers(t *testing.T) {
+  g := NewGeneratorFromBytes([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+  tests := []struct {
+    rtd  TypeDescriptor
+    want interface{}
+  }{
+    {Int8Type, int8(-1)},
+    {Int16Type, int16(-1)},
+    {Int32Type, int32(-1)},
+    {Int8Type, int8(0)},
+  }
+  for _, test := range tests {
+    if got := g.Generate(test.rtd); got != test.want {
+      t.Errorf("Generate(%v) = %#v, want %#v", test.rtd, got, test.want)
+    }
+  }
+}
+
+func TestGenerateCollections(t *testing.T) {
+  for seed := int64(0); seed < 20; seed++ {
+    g := NewGenerator(seed)
+    s := g.Generate(SeqTypeOf(CharType)).(Seq)
+    if s.LenInt() > g.MaxSize {
+      t.Errorf("generated %d elements, more than MaxSize", s.LenInt())
+    }
+    if String(s) != s.ToGoString() {
+      t.Errorf("generated seq<char> %q isn't a string", String(s))
+    }
+    m := g.Generate(MapTypeOf(IntType, SetTypeOf(BoolType))).(Map)
+    for it := m.Values().Iterator(); ; {
+      v, ok := it()
+      if !ok {
+        break
+      }
+      if _, isSet := v.(Set); !isSet {
+        t.Errorf("map value %v isn't a set", v)
+      }
+    }
+  }
+}
+
+func TestGenerateReplaysChoices(t *testing.T) {
+  rtd := SeqTypeOf(TupleType(IntType, MultiSetTypeOf(CharType)))
+  for seed := int64(0); seed < 20; seed++ {
+    g := NewGenerator(seed)
+    value := g.Generate(rtd)
+    if replayed := NewGeneratorFromBytes(g.Bytes()).Generate(rtd); !AreEqual(value, replayed) {
+      t.Errorf("seed %d generated %v, but its choices generate %v", seed, value, replayed)
+    }
+  }
+}
+
+func TestShrink(t *testing.T) {
+  // Fails for any sequence with an element of at least 3
+  prop := Property(func(g *Generator) bool {
+    s := g.Generate(SeqTypeOf(IntType)).(Seq)
+    for i := 0; i < s.LenInt(); i++ {
+      if s.IndexInt(i).(Int).Cmp(IntOf(3)) >= 0 {
+        return false
+      }
+    }
+    return true
+  })
+  for seed := int64(0); seed < 50; seed++ {
+    g := NewGenerator(seed)
+    if !prop.FailsOn(g) {
+      continue
+    }
+    shrunk := prop.Shrink(g.Bytes())
+    failed, values, _ := prop.Fails(shrunk)
+    if !failed || len(shrunk) > len(g.Bytes()) || values[0].(Seq).LenInt() != 1 {
+      t.Errorf("seed %d shrinks to %v (failing: %v), want a single failing element", seed, values, failed)
+    }
+  }
+}
+
+func TestFailsOnDiscardsOnlyItsOutput(t *testing.T) {
+  prop := Property(func(g *Generator) bool {
+    Print(SeqOfString("property"))
+    return g.Bool()
+  })
+  started, done, finished := make(chan struct{}), make(chan struct{}), make(chan struct{})
+  var captured string
+  go func() {
+    captured = CaptureOutput(func() {
+      close(started)
+      <-done
+      Print(SeqOfString("capture"))
+    })
+    close(finished)
+  }()
+  <-started
+  got := CaptureOutput(func() {
+    // Runs in a nested Call, without waiting for other calls
+    Call(context.Background(), func() {
+      for seed := int64(0); seed < 10; seed++ {
+        prop.FailsOn(NewGenerator(seed))
+      }
+    })
+    Print(SeqOfString("after"))
+  })
+  close(done)
+  <-finished
+  if got != "after" || captured != "capture" {
+    t.Errorf("captured %q and %q around FailsOn, want %q and %q", got, captured, "after", "capture")
+  }
+}
+
+func TestFailsOnCanceled(t *testing.T) {
+  ctx, cancel := context.WithCancel(context.Background())
+  prop := Property(func(g *Generator) bool {
+    cancel()
+    spin()
+    return true
+  })
+  failed := false
+  if err := Call(ctx, func() { failed = prop.FailsOn(NewGenerator(0)) }); err != context.Canceled || failed {
+    t.Errorf("Call = %v and failed = %v, want %v and no failure", err, failed, context.Canceled)
+  }
+}
+
+/******************************************************************************
+ * Program entry
+ ******************************************************************************/
+
+func TestMainExitCode(t *testing.T) {
+  defer SetExitCode(0)
+  defer SetHaltExitCode(0)
+
+  if code := mainExitCode(true); code != 0 {
+    t.Errorf("exit code after a halt = %d by default, want 0", code)
+  }
+  SetHaltExitCode(1)
+  if code := mainExitCode(true); code != 1 {
+    t.Errorf("exit code after a halt = %d after SetHaltExitCode(1), want 1", code)
+  }
+  if code := mainExitCode(false); code != 0 {
+    t.Errorf("exit code = %d by default, want 0", code)
+  }
+  SetExitCode(3)
+  if code := mainExitCode(false); code != 3 {
+    t.Errorf("exit code = %d after SetExitCode(3), want 3", code)
+  }
+  if code := mainExitCode(true); code != 1 {
+    t.Errorf("exit code after a halt = %d after SetExitCode(3), want 1", code)
+  }
+}
@@ -0,0 +1,44 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+// Package DafnyStats publishes the runtime statistics of a Dafny program
+// compiled to Go through expvar, for observing the program in production.  The
+// runtime only counts them once they're turned on, which Publish does, so a
+// program that doesn't call Publish pays for neither the counting nor expvar
+// (which registers the /debug/vars handler with http.DefaultServeMux).
+package DafnyStats
+
+import (
+  _dafny "dafny"
+  "expvar"
+  "sync"
+)
+
+// DefaultName is the expvar name under which Publish publishes the statistics.
+const DefaultName = "dafny"
+
+var mu sync.Mutex
+
+// Publish turns the runtime statistics on and publishes them as the expvar
+// variable DefaultName.  It's safe to call more than once.
+func Publish() {
+  PublishAs(DefaultName)
+}
+
+// PublishAs turns the runtime statistics on and publishes them as the expvar
+// variable with the given name.  If a variable of that name has already been
+// published (by an earlier call, say, or by another copy of the runtime linked
+// into the same program), it's left as it is rather than panicking, as
+// expvar.Publish would; PublishAs returns whether it published the variable.
+func PublishAs(name string) bool {
+  _dafny.EnableStats(true)
+  mu.Lock()
+  defer mu.Unlock()
+  if expvar.Get(name) != nil {
+    return false
+  }
+  expvar.Publish(name, expvar.Func(func() interface{} {
+    return _dafny.ReadStats()
+  }))
+  return true
+}
@@ -0,0 +1,34 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+package DafnyStats
+
+import (
+  _dafny "dafny"
+  "encoding/json"
+  "expvar"
+  "testing"
+)
+
+func TestPublish(t *testing.T) {
+  defer _dafny.EnableStats(false)
+  Publish()
+  Publish()
+  if PublishAs(DefaultName) {
+    t.Error("PublishAs published the same name twice")
+  }
+
+  before := _dafny.ReadStats().SeqSizes.Total()
+  _dafny.SeqOf(_dafny.One, _dafny.Two)
+  if after := _dafny.ReadStats().SeqSizes.Total(); after != before+1 {
+    t.Errorf("SeqSizes.Total() went from %d to %d, want one more", before, after)
+  }
+
+  var stats _dafny.Stats
+  if err := json.Unmarshal([]byte(expvar.Get(DefaultName).String()), &stats); err != nil {
+    t.Fatal(err)
+  }
+  if stats.SeqSizes.Total() == 0 {
+    t.Errorf("published stats %+v don't count the sequence", stats)
+  }
+}
@@ -0,0 +1,112 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+// Package DafnyTesting runs the {:test} methods of a Dafny program compiled
+// to Go under "go test", and checks properties over values generated by the
+// runtime's Generator.  The compiler emits it, along with a _test.go file
+// that calls RunTests, for programs that have tests; it's kept apart from the
+// runtime so that other programs don't link in the "testing" package.
+package DafnyTesting
+
+import (
+  "bytes"
+  "context"
+  _dafny "dafny"
+  "errors"
+  "strings"
+  "sync"
+  "testing"
+)
+
+// RunTests runs each registered test as a subtest of t.  What a test prints
+// is logged, and a test that halts or returns a failure fails with the halt
+// message or the failure.
+func RunTests(t *testing.T) {
+  for _, test := range _dafny.RegisteredTests() {
+    t.Run(test.Name, func(t *testing.T) {
+      RunTest(t, test)
+    })
+  }
+}
+
+// RunTest runs a single test, reporting to t as RunTests does.
+func RunTest(t testing.TB, test _dafny.TestCase) {
+  t.Helper()
+  out := &lockedBuffer{}
+  var failure interface{}
+  err := _dafny.Call(context.Background(), func() {
+    _dafny.RedirectOutput(out, func() {
+      failure = test.Run()
+    })
+  })
+  if printed := out.String(); printed != "" {
+    t.Log(printed)
+  }
+  var halt *_dafny.HaltError
+  switch {
+  case errors.As(err, &halt):
+    t.Fatal(_dafny.String(halt.Value))
+  case err != nil:
+    t.Fatal(err)
+  case failure != nil:
+    t.Fatal(_dafny.String(failure))
+  }
+}
+
+// CheckProperty runs the property on the values of the given number of
+// pseudo-random generators, determined by the seed.  On the first failure, it
+// shrinks the choices and fails the test, reporting the shrunk values and
+// choices (which can then be added to a fuzz corpus).
+func CheckProperty(t testing.TB, seed int64, runs int, prop _dafny.Property) {
+  t.Helper()
+  for run := 0; run < runs; run++ {
+    g := _dafny.NewGenerator(seed + int64(run))
+    if !prop.FailsOn(g) {
+      continue
+    }
+    shrunk := prop.Shrink(g.Bytes())
+    _, values, _ := prop.Fails(shrunk)
+    t.Fatalf("property fails (seed %d) for %s; choices %q", seed+int64(run), stringOfValues(values), shrunk)
+  }
+}
+
+// FuzzProperty runs the property under Go's native fuzzing, with the inputs of
+// the fuzz corpus as the choices of a Generator.  The fuzzer minimizes failing
+// inputs itself, which shrinks the values too.
+func FuzzProperty(f *testing.F, prop _dafny.Property) {
+  f.Helper()
+  f.Add([]byte{})
+  f.Fuzz(func(t *testing.T, data []byte) {
+    if failed, values, _ := prop.Fails(data); failed {
+      t.Fatalf("property fails for %s", stringOfValues(values))
+    }
+  })
+}
+
+// stringOfValues formats generated values as a comma-separated list.
+func stringOfValues(values []interface{}) string {
+  strs := make([]string, len(values))
+  for i, v := range values {
+    strs[i] = _dafny.StringOfElement(v)
+  }
+  return strings.Join(strs, ", ")
+}
+
+// A lockedBuffer is a bytes.Buffer that can be written to concurrently, by
+// the goroutines that a test starts.
+type lockedBuffer struct {
+  mu  sync.Mutex
+  buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return b.buf.String()
+}
@@ -0,0 +1,111 @@
+// Copyright by the contributors to the Dafny Project
+// SPDX-License-Identifier: MIT
+
+package DafnyTesting
+
+import (
+  _dafny "dafny"
+  "fmt"
+  "runtime"
+  "strings"
+  "testing"
+)
+
+// A recorder is a testing.TB that records what's reported to it.
+type recorder struct {
+  testing.TB
+  logs  []string
+  fatal string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Log(args ...interface{}) {
+  r.logs = append(r.logs, fmt.Sprint(args...))
+}
+
+func (r *recorder) Fatal(args ...interface{}) {
+  r.fatal = fmt.Sprint(args...)
+  runtime.Goexit()
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+  r.Fatal(fmt.Sprintf(format, args...))
+}
+
+// record calls f with a recorder, in a goroutine of its own so that Fatal can
+// end it.
+func record(f func(r *recorder)) *recorder {
+  r := &recorder{}
+  done := make(chan struct{})
+  go func() {
+    defer close(done)
+    f(r)
+  }()
+  <-done
+  return r
+}
+
+func run(test func() interface{}) *recorder {
+  return record(func(r *recorder) {
+    RunTest(r, _dafny.TestCase{Name: "Test", Run: test})
+  })
+}
+
+func TestRunTest(t *testing.T) {
+  tests := []struct {
+    name  string
+    run   func() interface{}
+    logs  int
+    fatal string
+  }{
+    {"passes", func() interface{} { return nil }, 0, ""},
+    {"prints", func() interface{} { _dafny.Print(_dafny.SeqOfString("hello")); return nil }, 1, ""},
+    {"fails", func() interface{} { return _dafny.SeqOfString("failure") }, 0, "failure"},
+    {"halts", func() interface{} { panic("expectation violation") }, 0, "expectation violation"},
+  }
+  for _, test := range tests {
+    r := run(test.run)
+    if len(r.logs) != test.logs || r.fatal != test.fatal {
+      t.Errorf("test that %s logged %q and failed with %q, want %d logs and %q", test.name, r.logs, r.fatal, test.logs, test.fatal)
+    }
+  }
+}
+
+func TestRunTestCapturesOutput(t *testing.T) {
+  r := run(func() interface{} {
+    _dafny.Print(_dafny.SeqOfString("hello"))
+    return nil
+  })
+  if len(r.logs) != 1 || r.logs[0] != "hello" {
+    t.Errorf("logs = %q, want [\"hello\"]", r.logs)
+  }
+}
+
+func TestCheckProperty(t *testing.T) {
+  holds := func(g *_dafny.Generator) bool {
+    s := g.Generate(_dafny.SeqTypeOf(_dafny.IntType)).(_dafny.Seq)
+    return s.LenInt() <= g.MaxSize
+  }
+  if r := record(func(r *recorder) { CheckProperty(r, 0, 100, holds) }); r.fatal != "" {
+    t.Errorf("property that holds failed with %q", r.fatal)
+  }
+
+  fails := func(g *_dafny.Generator) bool {
+    return g.Generate(_dafny.SeqTypeOf(_dafny.CharType)).(_dafny.Seq).LenInt() < 2
+  }
+  r := record(func(r *recorder) { CheckProperty(r, 0, 100, fails) })
+  // The shrunk counterexample has two of the simplest characters
+  if !strings.Contains(r.fatal, `property fails`) || !strings.Contains(r.fatal, `"aa"`) {
+    t.Errorf("property that fails failed with %q, want a shrunk counterexample", r.fatal)
+  }
+}
+
+func TestCheckPropertyHalt(t *testing.T) {
+  halts := func(g *_dafny.Generator) bool {
+    panic("expectation violation")
+  }
+  if r := record(func(r *recorder) { CheckProperty(r, 0, 1, halts) }); !strings.Contains(r.fatal, "property fails") {
+    t.Errorf("property that halts failed with %q", r.fatal)
+  }
+}
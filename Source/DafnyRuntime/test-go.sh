@@ -0,0 +1,31 @@
+#! /bin/bash
+
+# Runs the unit tests of the Go runtime.  The Go sources here are copied into
+# the packages they become in compiled programs (DafnyRuntime.go is package
+# dafny, and so on), in a temporary GOPATH.  Arguments are passed on to
+# "go test", e.g. ./test-go.sh -race -run TestCompare
+
+DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+GOPATH="$(mktemp -d)"
+trap 'rm -rf "$GOPATH"' EXIT
+
+PACKAGES=()
+add_package() {
+  local package=$1 source=$2
+  mkdir -p "$GOPATH/src/$package"
+  cp "$DIR/$source.go" "$GOPATH/src/$package/$package.go"
+  if [ -f "$DIR/${source}_test.go" ]; then
+    cp "$DIR/${source}_test.go" "$GOPATH/src/$package/${package}_test.go"
+  fi
+  PACKAGES+=("$package")
+}
+
+add_package dafny DafnyRuntime
+add_package DafnyIOExterns DafnyIO
+add_package DafnyProfiling DafnyProfiling
+add_package DafnyTesting DafnyTesting
+add_package DafnyStats DafnyStats
+
+export GOPATH GO111MODULE=off
+cd "$GOPATH/src" || exit 1
+go vet "${PACKAGES[@]}" && go test "$@" "${PACKAGES[@]}"